@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runChunks analyzes how much content the files of the paths share at the
+// level of content-defined chunks
+func runChunks(args []string) {
+	fs := flag.NewFlagSet("chunks", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: dups chunks [flags] PATH...")
+		fs.PrintDefaults()
+	}
+	flDB := fs.String("db", "", "sqlite3 database file to record the chunks of files in, to skip chunking the unchanged ones again")
+	flWorkers := fs.Int("w", runtime.NumCPU(), "number of files chunked concurrently")
+	flMin := fs.String("min", fmt.Sprint(dups.DefaultChunkParams.Min), "minimum chunk size (like 16K)")
+	flAvg := fs.String("avg", fmt.Sprint(dups.DefaultChunkParams.Avg), "average chunk size, rounded down to a power of two (like 64K)")
+	flMax := fs.String("max", fmt.Sprint(dups.DefaultChunkParams.Max), "maximum chunk size (like 256K)")
+	flMinSize := fs.String("min-size", "", "skip files smaller than this size (like 4K, 1M)")
+	flTop := fs.Int("top", 20, "number of pairs of files sharing the most content to list (0 for all)")
+	flJSON := fs.Bool("json", false, "output the analysis as JSON")
+	flVerbose := fs.Bool("v", false, "report each file chunked")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var params dups.ChunkParams
+	for _, f := range []struct {
+		value string
+		size  *int
+	}{{*flMin, &params.Min}, {*flAvg, &params.Avg}, {*flMax, &params.Max}} {
+		size, err := dups.ParseSize(f.value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		*f.size = int(size)
+	}
+	if err := params.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	filter := &dups.Filter{}
+	if *flMinSize != "" {
+		var err error
+		if filter.MinSize, err = dups.ParseSize(*flMinSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var store dups.Store
+	if *flDB != "" {
+		db, err := dups.OpenSQLite(*flDB)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		store = db
+	}
+	scanner := dups.NewChunkScanner(store)
+	scanner.Params = params
+	scanner.Filter = filter
+	scanner.Workers = *flWorkers
+	scanner.Verbose = *flVerbose
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, arg := range fs.Args() {
+		if err := scanner.Scan(ctx, arg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if store != nil {
+				store.Close()
+			}
+			os.Exit(1)
+		}
+	}
+
+	a, err := scanner.Analyze(*flTop)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error analyzing the chunks:", err)
+		if store != nil {
+			store.Close()
+		}
+		os.Exit(1)
+	}
+	if *flJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(a); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		mb := func(n int64) float64 { return float64(n) / 1024.0 / 1024.0 }
+		fmt.Printf("Chunk sizes:      %s\n", a.Params)
+		fmt.Printf("Files:            %d (%fmb)\n", a.Files, mb(a.Bytes))
+		fmt.Printf("Chunks:           %d, %d distinct\n", a.Chunks, a.UniqueChunks)
+		fmt.Printf("Distinct content: %fmb\n", mb(a.UniqueBytes))
+		percent := 0.0
+		if a.Bytes > 0 {
+			percent = 100 * float64(a.Savings) / float64(a.Bytes)
+		}
+		fmt.Printf("Savings:          %fmb (%.1f%%) with a block-level dedupe\n", mb(a.Savings), percent)
+		if a.CommonChunks > 0 {
+			fmt.Printf("Common chunks:    %d, of more than %d files each, not counted in the pairs\n", a.CommonChunks, dups.MaxPairedFiles)
+		}
+		if len(a.Pairs) > 0 {
+			fmt.Println("Pairs of files sharing the most content:")
+		}
+		for _, p := range a.Pairs {
+			fmt.Printf("\t%fmb\t%s\t%s\n", mb(p.Shared), p.A, p.B)
+		}
+	}
+	if len(scanner.Errors()) > 0 {
+		// files that could not be read are missing from the analysis
+		if store != nil {
+			store.Close()
+		}
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runDB runs the maintenance subcommands of a database
+func runDB(args []string) {
+	usage := "Usage: dups db prune|stats|vacuum|query -db FILE [flags]"
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	flDB := fs.String("db", "", "sqlite3 database file")
+	flJSON := fs.Bool("json", false, "output as JSON")
+	var (
+		flUnchecked *time.Duration
+		flDryRun    *bool
+		flHash      *string
+		flPath      *string
+	)
+	switch args[0] {
+	case "prune":
+		flUnchecked = fs.Duration("unchecked", 0, "also drop the records not checked by a scan for this long (like 720h)")
+		flDryRun = fs.Bool("n", false, "only list the records that would be dropped")
+	case "query":
+		flHash = fs.String("hash", "", "list the files of this content hash")
+		flPath = fs.String("path", "", "list the record of this file, or of the files under this directory")
+	case "stats", "vacuum":
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	fs.Parse(args[1:])
+	if *flDB == "" {
+		fmt.Fprintf(os.Stderr, "Error: db %s requires -db to be specified\n", args[0])
+		os.Exit(1)
+	}
+	db, err := dups.OpenSQLite(*flDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var out interface{}
+	switch args[0] {
+	case "prune":
+		var unchecked time.Time
+		if *flUnchecked > 0 {
+			unchecked = time.Now().Add(-*flUnchecked)
+		}
+		pruned, err := db.Prune(unchecked, *flDryRun)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error pruning database:", err)
+			os.Exit(1)
+		}
+		out = pruned
+		if !*flJSON {
+			for _, p := range pruned {
+				fmt.Printf("%s: %s\n", p.Path, p.Reason)
+			}
+			verb := "Dropped"
+			if *flDryRun {
+				verb = "Would drop"
+			}
+			fmt.Printf("%s %d records of database %s\n", verb, len(pruned), *flDB)
+		}
+	case "stats":
+		st, err := db.Stats()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error querying database:", err)
+			os.Exit(1)
+		}
+		out = st
+		if !*flJSON {
+			fmt.Printf("Schema version:   %d\n", st.SchemaVersion)
+			fmt.Printf("Records:          %d (%d without a size)\n", st.Records, st.Unsized)
+			fmt.Printf("Hashes:           %d\n", st.Hashes)
+			fmt.Printf("Size:             %fmb\n", float64(st.Bytes)/1024.0/1024.0)
+			algs := make([]string, 0, len(st.Algorithms))
+			for alg := range st.Algorithms {
+				algs = append(algs, alg)
+			}
+			sort.Strings(algs)
+			for _, alg := range algs {
+				fmt.Printf("  %-15s %d\n", alg+":", st.Algorithms[alg])
+			}
+			fmt.Printf("Duplicate groups: %d, %fmb reclaimable\n", st.DuplicateGroups, float64(st.Reclaimable)/1024.0/1024.0)
+			if !st.OldestChecked.IsZero() {
+				fmt.Printf("Checked:          %s to %s\n", st.OldestChecked.Local().Format(time.RFC3339), st.NewestChecked.Local().Format(time.RFC3339))
+			}
+			fmt.Printf("Scan errors:      %d\n", st.Errors)
+		}
+	case "vacuum":
+		if err := db.Vacuum(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error vacuuming database:", err)
+			os.Exit(1)
+		}
+		return
+	case "query":
+		var entries []dups.Entry
+		switch {
+		case *flHash != "":
+			entries, err = db.ByHash(*flHash)
+		case *flPath != "":
+			entries, err = db.ByPath(*flPath)
+		default:
+			fmt.Fprintln(os.Stderr, "Error: db query requires -hash or -path to be specified")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error querying database:", err)
+			os.Exit(1)
+		}
+		out = entries
+		if !*flJSON {
+			for _, e := range entries {
+				fmt.Printf("%s %d %s\n", e.Hash, e.Size, e.Path)
+			}
+		}
+	}
+
+	if *flJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runDiff compares the content of two trees, each walked and hashed or read
+// from the records of a database
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: dups diff [flags] A B")
+		fs.PrintDefaults()
+	}
+	flDB := fs.String("db", "", "sqlite3 database file of the hashes of the trees walked, to skip hashing unchanged files and record the others")
+	flDBA := fs.String("a-db", "", "read tree A from the records of this sqlite3 database instead of walking it")
+	flDBB := fs.String("b-db", "", "read tree B from the records of this sqlite3 database instead of walking it")
+	flWorkers := fs.Int("w", runtime.NumCPU(), "number of workers for measurements")
+	flHash := fs.String("hash", string(dups.DefaultAlgorithm), fmt.Sprintf("hash algorithm for file content (%s)", algorithmNames()))
+	flJSON := fs.Bool("json", false, "output the differences as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	algorithm, err := dups.ParseAlgorithm(*flHash)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	var store dups.Store = dups.NewMapStore()
+	if *flDB != "" {
+		db, err := dups.OpenSQLite(*flDB)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		store = db
+	}
+	scanner := dups.NewScanner(store)
+	scanner.Workers = *flWorkers
+	scanner.Algorithm = algorithm
+	scanner.Quiet = true
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var trees [2]dups.Tree
+	for i, dbPath := range []string{*flDBA, *flDBB} {
+		root := fs.Arg(i)
+		if dbPath != "" {
+			trees[i], err = readTree(dbPath, root)
+		} else {
+			trees[i], err = scanTree(ctx, scanner, root)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", root, err)
+			store.Close()
+			os.Exit(1)
+		}
+	}
+	if algs := treeAlgorithms(trees[0], trees[1]); len(algs) > 1 {
+		fmt.Fprintf(os.Stderr, "Error: the trees are hashed with different algorithms (%v), see -hash\n", algs)
+		store.Close()
+		os.Exit(1)
+	}
+
+	d := dups.Compare(trees[0], trees[1])
+	if *flJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(d); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		for _, f := range d.OnlyA {
+			fmt.Printf("only in A: %s\n", f.Path)
+		}
+		for _, f := range d.OnlyB {
+			fmt.Printf("only in B: %s\n", f.Path)
+		}
+		for _, p := range d.Moved {
+			fmt.Printf("moved: %s -> %s\n", p.A.Path, p.B.Path)
+		}
+		for _, p := range d.Changed {
+			fmt.Printf("changed: %s, %s\n", p.A.Path, p.B.Path)
+		}
+		fmt.Printf("%d same, %d changed, %d moved, %d only in A, %d only in B\n",
+			d.Same, len(d.Changed), len(d.Moved), len(d.OnlyA), len(d.OnlyB))
+	}
+	if len(scanner.Errors()) > 0 {
+		// files that could not be read are missing from the comparison
+		store.Close()
+		os.Exit(2)
+	}
+}
+
+// scanTree walks and hashes the tree at root
+func scanTree(ctx context.Context, scanner *dups.Scanner, root string) (dups.Tree, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dups.Entry
+	scanner.Seen = func(e dups.Entry) {
+		entries = append(entries, e)
+	}
+	defer func() { scanner.Seen = nil }()
+	if _, err := scanner.ScanContext(ctx, abs); err != nil {
+		return nil, err
+	}
+	return dups.NewTree(abs, entries), nil
+}
+
+// readTree reads the records of the files under root from the database at
+// dbPath
+func readTree(dbPath, root string) (dups.Tree, error) {
+	db, err := dups.OpenSQLiteReadOnly(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return dups.TreeOf(db, root)
+}
+
+// treeAlgorithms lists the hash algorithms of the entries of trees
+func treeAlgorithms(trees ...dups.Tree) []dups.Algorithm {
+	seen := map[dups.Algorithm]bool{}
+	var algs []dups.Algorithm
+	for _, t := range trees {
+		for _, e := range t {
+			if alg, _ := dups.SplitDigest(e.Hash); !seen[alg] {
+				seen[alg] = true
+				algs = append(algs, alg)
+			}
+		}
+	}
+	return algs
+}
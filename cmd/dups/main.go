@@ -1,698 +1,552 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha1"
-	"database/sql"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
-	"sync"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/vbatts/utils/pkg/dups"
 )
 
 var (
-	flLoadMap  = flag.String("l", "", "load existing map from file (JSON format)")
-	flSaveMap  = flag.String("o", "", "file to save map of file hashes to (JSON format) - empty means no output")
-	flDB       = flag.String("db", "", "sqlite3 database file for input/output (primary storage)")
-	flImport   = flag.String("import-json", "", "import hash map from JSON file into database (requires -db)")
-	flExport   = flag.String("export-json", "", "export hash map from database to JSON file (requires -db)")
-	flWorkers  = flag.Int("w", runtime.NumCPU(), "number of workers for measurements")
-	flHardlink = flag.Bool("H", false, "hardlink the duplicate files")
+	flLoadMap       = flag.String("l", "", "load existing map from file (JSON format)")
+	flSaveMap       = flag.String("o", "", "file to save map of file hashes to (JSON format) - empty means no output")
+	flDB            = flag.String("db", "", "sqlite3 database file for input/output (primary storage)")
+	flImport        = flag.String("import-json", "", "import hash map from JSON file into database (requires -db)")
+	flExport        = flag.String("export-json", "", "export hash map from database to JSON file (requires -db)")
+	flWorkers       = flag.Int("w", runtime.NumCPU(), "number of workers for measurements")
+	flBatch         = flag.Int("batch", dups.DefaultBatchSize, "number of records written to the database per transaction")
+	flHardlink      = flag.Bool("H", false, "hardlink the duplicate files")
 	flHardlinkPaths = flag.String("H-paths", "", "comma-separated list of allowed paths for hardlinking (if specified, only hardlink within these paths)")
-	flSymlink  = flag.Bool("s", false, "symlink the duplicate files")
-	flQuiet    = flag.Bool("q", false, "less output")
-	flVerbose  = flag.Bool("v", false, "more output")
-	nprocs     = 1
+	flSymlink       = flag.Bool("s", false, "symlink the duplicate files")
+	flReflink       = flag.Bool("reflink", false, "share the data extents of the duplicate files, on copy-on-write filesystems like btrfs and XFS")
+	flTrash         = flag.String("trash", "", "move the duplicate files into this directory, at their absolute path under it, to be restored by \"dups restore\" (requires -db)")
+	flKeep          = flag.String("keep", "", fmt.Sprintf("comma-separated criteria choosing the copy kept of duplicates, in order of precedence (%s)", criterionNames()))
+	flKeepPrefix    = flag.String("keep-prefix", "", "comma-separated list of directories whose copies are kept over others, the first one first")
+	flIgnoreAttrs   = flag.String("ignore-attrs", "", fmt.Sprintf("comma-separated attributes that may differ between files linked by -H or -s (%s)", attributeNames()))
+	flMinSize       = flag.String("min-size", "", "skip files smaller than this size (like 4K, 1M)")
+	flMaxSize       = flag.String("max-size", "", "skip files larger than this size (like 4K, 1M)")
+	flSkipHidden    = flag.Bool("skip-hidden", false, "skip files and directories whose name starts with \".\"")
+	flSkipVCS       = flag.Bool("skip-vcs", false, "skip the directories of version control systems, like .git")
+	flIgnoreFile    = flag.String("ignore-file", dups.DefaultIgnoreFile, "name of the files with gitignore-style patterns of the paths to skip under their directory (empty to not read them)")
+	flInclude       patternsFlag
+	flExclude       patternsFlag
+	flProgress      = flag.Bool("progress", false, "show a progress line while scanning, after counting the files")
+	flSummary       = flag.String("summary", "", "print a summary of the scan at the end, as \"text\" or \"json\"")
+	flFailOn        = flag.String("fail-on", "any", "errors of the scan that make the exit status 2: \"any\", \"none\", or a comma-separated list of kinds (permission, vanished, walk, read, store, link)")
+	flQuiet         = flag.Bool("q", false, "less output")
+	flVerbose       = flag.Bool("v", false, "more output")
+	flHash          = flag.String("hash", string(dups.DefaultAlgorithm), fmt.Sprintf("hash algorithm for file content (%s)", algorithmNames()))
+	flMigrate       = flag.Bool("migrate", false, "rehash the database records made with another algorithm than -hash (requires -db)")
+	flPlan          = flag.String("plan", "", "write the actions of -H, -s, -reflink or -trash to this file (JSON format) instead of taking them")
+	flJournal       = flag.String("journal", "", "append a record of each link made by -H, -s, -reflink or -apply to this file (JSON lines), for \"dups undo\"")
+	flApply         = flag.String("apply", "", "take the actions of a plan file written by -plan, after checking the files are unchanged (with -trash and -db for those of -trash)")
+	flSimilar       = flag.String("similar", "", fmt.Sprintf("also group the JPEG and PNG images that look alike by this perceptual hash (%s), reported apart and never linked", imageAlgorithmNames()))
+	flArchives      = flag.Bool("archives", false, "also hash the members of tar, tar.gz and zip archives, as paths like foo.tar.gz!/dir/file that are reported but never linked")
+	flSimilarDist   = flag.Int("similar-distance", dups.DefaultSimilarDistance, "the number of bits the perceptual hashes of similar images may differ by")
+	flVerify        = flag.Bool("verify", false, "rehash files even when their database record is unchanged, and report those whose content drifted")
+	flPrefilter     = flag.Bool("prefilter", false, "only hash files that share their size, and head/tail sample, with another file (unique files are not recorded)")
+	flWatch         = flag.Bool("watch", false, "after scanning, keep watching the paths and scan the files written under them, once unwritten for -settle, until interrupted")
+	flSettle        = flag.Duration("settle", dups.DefaultSettle, "how long a file must go unwritten for -watch to scan it")
+	nprocs          = 1
 )
 
-// isPathAllowed checks if a path is within any of the allowed paths
-func isPathAllowed(path string, allowedPaths []string) bool {
-	if len(allowedPaths) == 0 {
-		// If no allowed paths specified, all paths are allowed
-		return true
+func init() {
+	flag.Var(&flInclude, "include", "only scan the files matching this glob, or regular expression prefixed with \"re:\" (may be repeated)")
+	flag.Var(&flExclude, "exclude", "skip the files and directories matching this glob, or regular expression prefixed with \"re:\" (may be repeated)")
+	nprocs = runtime.NumCPU()
+	runtime.GOMAXPROCS(nprocs)
+}
+
+func algorithmNames() string {
+	var names []string
+	for _, a := range dups.Algorithms() {
+		names = append(names, string(a))
 	}
+	return strings.Join(names, ", ")
+}
 
-	// Clean the path for comparison
-	cleanPath := filepath.Clean(path)
+// patternsFlag collects the patterns of a repeated flag
+type patternsFlag []dups.Pattern
 
-	for _, allowedPath := range allowedPaths {
-		// Convert allowed path to absolute path if it's not already
-		absAllowedPath := allowedPath
-		if !filepath.IsAbs(allowedPath) {
-			var err error
-			absAllowedPath, err = filepath.Abs(allowedPath)
-			if err != nil {
-				continue
-			}
-		}
+func (p *patternsFlag) String() string {
+	var names []string
+	for _, pat := range *p {
+		names = append(names, pat.String())
+	}
+	return strings.Join(names, ", ")
+}
 
-		// Check if the path is within the allowed path
-		rel, err := filepath.Rel(absAllowedPath, cleanPath)
-		if err != nil {
-			continue
-		}
-		// If the relative path doesn't start with "..", it's within the allowed path
-		if !strings.HasPrefix(rel, "..") {
-			return true
-		}
+func (p *patternsFlag) Set(s string) error {
+	pat, err := dups.ParsePattern(s)
+	if err != nil {
+		return err
 	}
-	return false
+	*p = append(*p, pat)
+	return nil
 }
 
-func init() {
-	nprocs = runtime.NumCPU()
-	runtime.GOMAXPROCS(nprocs)
+func imageAlgorithmNames() string {
+	var names []string
+	for _, a := range dups.ImageAlgorithms() {
+		names = append(names, string(a))
+	}
+	return strings.Join(names, ", ")
+}
+
+func attributeNames() string {
+	var names []string
+	for _, a := range dups.Attributes() {
+		names = append(names, string(a))
+	}
+	return strings.Join(names, ", ")
+}
+
+func criterionNames() string {
+	var names []string
+	for _, c := range dups.Criteria() {
+		names = append(names, string(c))
+	}
+	return strings.Join(names, ", ")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "db":
+			runDB(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "undo":
+			runUndo(os.Args[2:])
+			return
+		case "chunks":
+			runChunks(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
 
 	// Parse allowed hardlink paths if specified
 	var allowedHardlinkPaths []string
 	if *flHardlinkPaths != "" {
-		paths := strings.Split(*flHardlinkPaths, ",")
-		// Clean up and convert paths to absolute
-		for _, path := range paths {
-			cleanPath := filepath.Clean(strings.TrimSpace(path))
-			if !filepath.IsAbs(cleanPath) {
-				absPath, err := filepath.Abs(cleanPath)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error converting path to absolute: %s, %v\n", cleanPath, err)
-					continue
-				}
-				allowedHardlinkPaths = append(allowedHardlinkPaths, absPath)
-			} else {
-				allowedHardlinkPaths = append(allowedHardlinkPaths, cleanPath)
-			}
+		var err error
+		allowedHardlinkPaths, err = dups.CleanPaths(strings.Split(*flHardlinkPaths, ","))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
 		}
 	}
 
-	found := map[string]string{}
-	if len(*flLoadMap) > 0 {
-		fh, err := os.Open(*flLoadMap)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	algorithm, err := dups.ParseAlgorithm(*flHash)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	var keepPrefixes []string
+	if *flKeepPrefix != "" {
+		keepPrefixes = strings.Split(*flKeepPrefix, ",")
+	}
+	keep, err := dups.ParseKeep(*flKeep, keepPrefixes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	var imageAlgorithm dups.ImageAlgorithm
+	if *flSimilar != "" {
+		if imageAlgorithm, err = dups.ParseImageAlgorithm(*flSimilar); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
 			os.Exit(1)
 		}
-		buf, err := io.ReadAll(fh)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	}
+
+	ignoreAttributes, err := dups.ParseAttributes(*flIgnoreAttrs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	failPolicy, err := dups.ParseFailPolicy(*flFailOn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	filter := &dups.Filter{
+		Include:    flInclude,
+		Exclude:    flExclude,
+		SkipHidden: *flSkipHidden,
+		SkipVCS:    *flSkipVCS,
+		IgnoreFile: *flIgnoreFile,
+	}
+	if *flMinSize != "" {
+		if filter.MinSize, err = dups.ParseSize(*flMinSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
 			os.Exit(1)
 		}
-		if err = json.Unmarshal(buf, &found); err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	}
+	if *flMaxSize != "" {
+		if filter.MaxSize, err = dups.ParseSize(*flMaxSize); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
 			os.Exit(1)
 		}
 	}
 
+	if *flSummary != "" && *flSummary != "text" && *flSummary != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown summary format %q\n", *flSummary)
+		os.Exit(1)
+	}
+
 	// Check if we're importing a JSON file into the database
 	if *flImport != "" {
 		if *flDB == "" {
 			fmt.Fprintln(os.Stderr, "Error: -import-json requires -db to be specified")
 			os.Exit(1)
 		}
+		importJSON(*flImport, *flDB)
+		return // Exit early after import
+	}
 
-		var err error
-		db, err := sql.Open("sqlite3", *flDB)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+	// Check if we're exporting the database to JSON
+	if *flExport != "" {
+		if *flDB == "" {
+			fmt.Fprintln(os.Stderr, "Error: -export-json requires -db to be specified")
 			os.Exit(1)
 		}
-		defer db.Close()
+		exportJSON(*flDB, *flExport)
+		return // Exit early after export
+	}
 
-		// Create table if it doesn't exist
-		sqlStmt := `CREATE TABLE IF NOT EXISTS file_hashes (
-			id INTEGER PRIMARY KEY,
-			hash TEXT NOT NULL,
-			file_path TEXT NOT NULL UNIQUE,
-			device_id TEXT,  -- Store device ID as string (major:minor)
-			size INTEGER,
-			modified_time DATETIME,
-			checked_time DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE INDEX IF NOT EXISTS idx_hash ON file_hashes(hash);
-		CREATE INDEX IF NOT EXISTS idx_file_path ON file_hashes(file_path);
-		CREATE INDEX IF NOT EXISTS idx_device_id ON file_hashes(device_id);
-		CREATE INDEX IF NOT EXISTS idx_checked_time ON file_hashes(checked_time);`
-
-		_, err = db.Exec(sqlStmt)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error creating table:", err)
-			os.Exit(1)
-		}
+	// Check if we're applying a plan
+	if *flApply != "" {
+		applyPlan(*flApply, *flTrash, *flDB, allowedHardlinkPaths, ignoreAttributes, openJournal())
+		return
+	}
+	if *flReflink && (*flHardlink || *flSymlink) {
+		fmt.Fprintln(os.Stderr, "Error: -reflink can not be combined with -H or -s")
+		os.Exit(1)
+	}
+	if *flTrash != "" && (*flHardlink || *flSymlink || *flReflink) {
+		fmt.Fprintln(os.Stderr, "Error: -trash can not be combined with -H, -s or -reflink")
+		os.Exit(1)
+	}
+	if *flTrash != "" && *flDB == "" && *flPlan == "" {
+		fmt.Fprintln(os.Stderr, "Error: -trash requires -db to be specified, to record the moves")
+		os.Exit(1)
+	}
+	if !algorithm.CollisionResistant() && (*flHardlink || *flSymlink || *flTrash != "") {
+		// reflinks are safe, as the kernel compares the content first
+		fmt.Fprintf(os.Stderr, "Error: -hash %s is not collision resistant, and can not be used to replace files with -H, -s or -trash\n", algorithm)
+		os.Exit(1)
+	}
+	if *flWatch && *flPrefilter {
+		fmt.Fprintln(os.Stderr, "Error: -watch can not be combined with -prefilter, which leaves the unique files unhashed")
+		os.Exit(1)
+	}
+	if *flPlan != "" && !*flHardlink && !*flSymlink && !*flReflink && *flTrash == "" {
+		fmt.Fprintln(os.Stderr, "Error: -plan requires -H, -s, -reflink or -trash to be specified")
+		os.Exit(1)
+	}
 
-		// Load the JSON file
-		jsonFile, err := os.Open(*flImport)
+	var (
+		store  dups.Store
+		loaded *dups.MapStore
+	)
+	if len(*flLoadMap) > 0 {
+		groups, err := readGroups(*flLoadMap)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening JSON file:", err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		defer jsonFile.Close()
-
-		buf, err := io.ReadAll(jsonFile)
+		loaded = dups.NewMapStoreFromGroups(groups)
+	}
+	if *flDB != "" {
+		db, err := dups.OpenSQLite(*flDB)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error reading JSON file:", err)
+			fmt.Fprintln(os.Stderr, "Error opening database:", err)
 			os.Exit(1)
 		}
+		defer db.Close()
+		store = db
+	} else if loaded != nil {
+		store = loaded
+	} else {
+		store = dups.NewMapStore()
+	}
 
-		var importedMap map[string]string
-		if err = json.Unmarshal(buf, &importedMap); err != nil {
-			fmt.Fprintln(os.Stderr, "Error parsing JSON file:", err)
-			os.Exit(1)
+	scanner := dups.NewScanner(store)
+	scanner.Workers = *flWorkers
+	scanner.BatchSize = *flBatch
+	scanner.Algorithm = algorithm
+	scanner.Quiet = *flQuiet
+	scanner.Verbose = *flVerbose
+	scanner.Prefilter = *flPrefilter
+	scanner.Verify = *flVerify
+	scanner.Images = imageAlgorithm
+	scanner.Archives = *flArchives
+	scanner.Keep = keep
+	scanner.Filter = filter
+	if *flProgress {
+		scanner.Progress = os.Stderr
+	}
+	if *flHardlink || *flSymlink || *flReflink {
+		scanner.Linker = &dups.Linker{
+			Hard:             *flHardlink,
+			Symbolic:         *flSymlink,
+			Reflink:          *flReflink,
+			AllowedPaths:     allowedHardlinkPaths,
+			IgnoreAttributes: ignoreAttributes,
+			Journal:          openJournal(),
 		}
-
-		// Import the data into the database
-		tx, err := db.Begin()
+	}
+	if *flTrash != "" {
+		trash, err := dups.NewTrash(*flTrash)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error beginning transaction:", err)
+			fmt.Fprintln(os.Stderr, "Error:", err)
 			os.Exit(1)
 		}
+		scanner.Linker = &dups.Linker{Trash: trash}
+		if *flPlan == "" {
+			fmt.Fprintf(os.Stderr, "moving duplicates to %q, as run %s\n", trash.Dir, trash.Run)
+		}
+	}
+	if *flPlan != "" {
+		scanner.Plan = dups.NewPlan()
+	}
 
-		stmt, err := tx.Prepare("INSERT OR IGNORE INTO file_hashes (hash, file_path, device_id) VALUES (?, ?, ?)")
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error preparing statement:", err)
+	if *flMigrate {
+		if *flDB == "" {
+			fmt.Fprintln(os.Stderr, "Error: -migrate requires -db to be specified")
 			os.Exit(1)
 		}
-		defer stmt.Close()
-
-		count := 0
-		for hash, path := range importedMap {
-			// Get device ID for the file
-			var deviceId string
-			stat, err := os.Stat(path)
-			if err != nil {
-				// If file doesn't exist, skip device ID
-				deviceId = ""
-			} else {
-				sysStat, ok := stat.Sys().(*syscall.Stat_t)
-				if ok {
-					// Use major device number only (not inode number)
-					majorDev := (sysStat.Dev >> 8) & 0xff | ((sysStat.Dev >> 32) & 0xfff00) // Extract major device number
-					deviceId = fmt.Sprintf("%d", majorDev)
-				} else {
-					deviceId = ""
-				}
-			}
-			_, err = stmt.Exec(hash, path, deviceId)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error inserting record:", err)
-				continue
-			}
-			count++
-		}
-
-		if err = tx.Commit(); err != nil {
-			fmt.Fprintln(os.Stderr, "Error committing transaction:", err)
+		count, err := scanner.Rehash()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error migrating database:", err)
 			os.Exit(1)
 		}
-
-		fmt.Printf("Successfully imported %d records from %s into database %s\n", count, *flImport, *flDB)
-		return // Exit early after import
+		fmt.Printf("Rehashed %d records of database %s with %s\n", count, *flDB, algorithm)
 	}
 
-	// Check if we're exporting the database to JSON
-	if *flExport != "" {
-		if *flDB == "" {
-			fmt.Fprintln(os.Stderr, "Error: -export-json requires -db to be specified")
+	// Prefer the loaded map over the existing data of the database
+	if loaded != nil {
+		if err := scanner.Load(loaded); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+	} else if err := scanner.Load(store); err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
+	}
 
-		db, err := sql.Open("sqlite3", *flDB)
+	// Stop scanning on an interrupt, with the files hashed so far recorded
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, arg := range flag.Args() {
+		stats, err := scanner.ScanContext(ctx, arg)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+			fmt.Fprintln(os.Stderr, err)
+			store.Close()
 			os.Exit(1)
 		}
-		defer db.Close()
+		fmt.Printf("Savings of %fmb\n", float64(stats.BytesReclaimable)/1024.0/1024.0)
 
-		// Query all records from the database
-		rows, err := db.Query("SELECT hash, file_path FROM file_hashes")
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error querying database:", err)
-			os.Exit(1)
-		}
-		defer rows.Close()
-
-		exportMap := make(map[string]string)
-		for rows.Next() {
-			var hash, filePath string
-			err = rows.Scan(&hash, &filePath)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error scanning row:", err)
-				continue
+		// Only write the JSON file if the -o flag is specified with a non-empty value
+		if *flSaveMap != "" {
+			if err = writeGroups(*flSaveMap, store); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
 			}
-			exportMap[hash] = filePath
+			fmt.Fprintf(os.Stderr, "wrote %q\n", *flSaveMap)
 		}
-
-		// Write the map to the JSON file
-		jsonFile, err := os.Create(*flExport)
+	}
+	if *flWatch {
+		watcher := dups.NewWatcher(scanner)
+		watcher.Settle = *flSettle
+		watcher.Ignore = []string{*flDB, *flJournal, *flSaveMap, *flPlan}
+		fmt.Fprintf(os.Stderr, "watching %s for files written, until interrupted\n", strings.Join(flag.Args(), ", "))
+		if err := watcher.Watch(ctx, flag.Args()...); err != nil {
+			fmt.Fprintln(os.Stderr, "Error watching:", err)
+			store.Close()
+			os.Exit(1)
+		}
+	}
+	if flag.NArg() > 1 || *flWatch {
+		fmt.Printf("Total savings of %fmb\n", float64(scanner.Stats().BytesReclaimable)/1024.0/1024.0)
+	}
+	if scanner.Plan != nil {
+		fh, err := os.Create(*flPlan)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error creating JSON file:", err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		defer jsonFile.Close()
-
-		encoder := json.NewEncoder(jsonFile)
-		encoder.SetIndent("", "  ")
-		if err = encoder.Encode(exportMap); err != nil {
-			fmt.Fprintln(os.Stderr, "Error encoding JSON:", err)
+		if err = dups.WritePlan(fh, scanner.Plan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-
-		fmt.Printf("Successfully exported %d records from database %s to %s\n", len(exportMap), *flDB, *flExport)
-		return // Exit early after export
+		fh.Close()
+		fmt.Fprintf(os.Stderr, "wrote %d actions saving %fmb to %q\n",
+			len(scanner.Plan.Actions), float64(scanner.Plan.Savings)/1024.0/1024.0, *flPlan)
 	}
-
-	// Initialize database if provided (but not for import)
-	var db *sql.DB
-	if *flDB != "" {
-		var err error
-		db, err = sql.Open("sqlite3", *flDB)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+	if imageAlgorithm != "" {
+		printSimilar(scanner.SimilarImages(*flSimilarDist), *flSimilarDist)
+	}
+	if mismatched := scanner.Mismatched(); len(mismatched) > 0 {
+		reportMismatched(mismatched)
+	}
+	if *flPrefilter && !*flQuiet {
+		stats := scanner.Stats()
+		fmt.Printf("Prefilter skipped %d files of unique size and %d of unique sample, avoiding reads of %fmb\n",
+			stats.FilesUniqueSize, stats.FilesUniqueSample, float64(stats.BytesAvoided)/1024.0/1024.0)
+	}
+	if *flSummary != "" {
+		if err := writeSummary(os.Stdout, *flSummary, scanner.Stats()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		defer db.Close()
-
-		// Create table if it doesn't exist
-		sqlStmt := `CREATE TABLE IF NOT EXISTS file_hashes (
-			id INTEGER PRIMARY KEY,
-			hash TEXT NOT NULL,
-			file_path TEXT NOT NULL UNIQUE,
-			device_id TEXT,  -- Store device ID as string (major:minor)
-			size INTEGER,
-			modified_time DATETIME,
-			checked_time DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE INDEX IF NOT EXISTS idx_hash ON file_hashes(hash);
-		CREATE INDEX IF NOT EXISTS idx_file_path ON file_hashes(file_path);
-		CREATE INDEX IF NOT EXISTS idx_device_id ON file_hashes(device_id);
-		CREATE INDEX IF NOT EXISTS idx_checked_time ON file_hashes(checked_time);`
-
-		_, err = db.Exec(sqlStmt)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Error creating table:", err)
+	}
+	if *flVerify {
+		stats := scanner.Stats()
+		fmt.Printf("Verified %d files, %d drifted from their record\n", stats.FilesVerified, stats.FilesDrifted)
+		if stats.FilesDrifted > 0 {
 			os.Exit(1)
 		}
-
-		// Load existing data from database if no load map was provided
-		if len(*flLoadMap) == 0 {
-			rows, err := db.Query("SELECT hash, file_path FROM file_hashes")
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error querying database:", err)
-				os.Exit(1)
-			}
-			defer rows.Close()
-
-			for rows.Next() {
-				var hash, filePath string
-				err = rows.Scan(&hash, &filePath)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error scanning row:", err)
-					continue
-				}
-				found[hash] = filePath
-			}
+	}
+	if errs := scanner.Errors(); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d errors during the scan\n", len(errs))
+		if failPolicy.Fails(errs) {
+			os.Exit(2)
 		}
 	}
+}
 
-	for _, arg := range flag.Args() {
-		savings := int64(0)
-
-		workers := make(chan int, *flWorkers)
-		mu := sync.Mutex{}
+// openJournal opens the file of -journal, or returns nil when it is not set
+func openJournal() *dups.Journal {
+	if *flJournal == "" {
+		return nil
+	}
+	journal, err := dups.OpenJournal(*flJournal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening journal:", err)
+		os.Exit(1)
+	}
+	return journal
+}
 
-		// Channel for sending measurements to database
-		type measurement struct {
-			hash    string
-			path    string
-			size    int64
-		}
-		measurements := make(chan measurement, *flWorkers*2) // Buffered channel
-
-		// Start database writer goroutine if DB is provided
-		var wgDB sync.WaitGroup
-		if db != nil {
-			wgDB.Add(1)
-			go func() {
-				defer wgDB.Done()
-				for m := range measurements {
-					// Insert the record in the database (ignore if file_path already exists)
-					stmt, err := db.Prepare("INSERT OR IGNORE INTO file_hashes (hash, file_path, device_id, size, modified_time) VALUES (?, ?, ?, ?, ?)")
-					if err != nil {
-						fmt.Fprintln(os.Stderr, "Error preparing statement:", err)
-						continue
-					}
-					// Get file modification time and device ID
-					info, err := os.Stat(m.path)
-					var modTime string
-					var deviceId string
-					if err != nil {
-						modTime = ""
-						deviceId = ""
-					} else {
-						modTime = info.ModTime().Format("2006-01-02 15:04:05")
-						sysStat, ok := info.Sys().(*syscall.Stat_t)
-						if ok {
-							// Use major device number only (not inode number)
-							majorDev := (sysStat.Dev >> 8) & 0xff | ((sysStat.Dev >> 32) & 0xfff00) // Extract major device number
-							deviceId = fmt.Sprintf("%d", majorDev)
-						} else {
-							deviceId = ""
-						}
-					}
-					_, err = stmt.Exec(m.hash, m.path, deviceId, m.size, modTime)
-					if err != nil {
-						fmt.Fprintln(os.Stderr, "Error inserting record:", err)
-					}
-					stmt.Close()
-				}
-			}()
+// reportMismatched lists the groups of duplicates with files left unlinked, as
+// their metadata differs from the copy kept
+func reportMismatched(mismatched map[string][]*dups.MismatchError) {
+	hashes := make([]string, 0, len(mismatched))
+	for hash := range mismatched {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	fmt.Printf("Skipped linking files of %d groups for differing metadata (see -ignore-attrs):\n", len(hashes))
+	for _, hash := range hashes {
+		fmt.Printf("%s\n", hash)
+		for _, err := range mismatched[hash] {
+			fmt.Printf("\t%q: %s\n", err.Path, strings.Join(err.Diffs, ", "))
 		}
+	}
+}
 
-		// WaitGroup to track all worker goroutines
-		var wgWorkers sync.WaitGroup
-
-		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
-			/*
-				if err != nil {
-					return err
-				}
-			*/
-			if !info.Mode().IsRegular() {
-				return nil
-			}
-			workers <- 1
-			wgWorkers.Add(1)
-			go func() {
-				defer wgWorkers.Done()
-				defer func() { <-workers }()
-
-				// Get the absolute filename
-				absPath, err := filepath.Abs(path)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err, path)
-					return
-				}
-
-				// Check if this file path already exists in the database
-				var existingHash string
-				var existingSize int64
-				var existingDeviceId string
-				if db != nil {
-					row := db.QueryRow("SELECT hash, size, device_id FROM file_hashes WHERE file_path = ?", absPath)
-					err = row.Scan(&existingHash, &existingSize, &existingDeviceId)
-					if err == nil {
-						// File exists in database, check if size has changed
-						if existingSize == info.Size() {
-							// File size hasn't changed, assume content is the same (skip checksum)
-							if *flVerbose {
-								fmt.Printf("SKIPPED checksum for %s (already in DB, size unchanged: %d bytes)\n", absPath, existingSize)
-							}
-
-							// Get current device ID
-							sysStat, ok := info.Sys().(*syscall.Stat_t)
-							if !ok {
-								// If we can't get device info, skip hardlinking
-								if *flVerbose {
-									fmt.Printf("Skipped hardlink: could not get device info for %s\n", absPath)
-								}
-							}
-							var currentMajorDev uint64
-							if ok {
-								// Extract major device number
-								currentMajorDev = (sysStat.Dev >> 8) & 0xff | ((sysStat.Dev >> 32) & 0xfff00)
-							}
-
-							mu.Lock()
-							defer mu.Unlock()
-							if fpath, ok := found[existingHash]; ok && fpath != absPath {
-								if !(*flQuiet) {
-									fmt.Printf("%q is the same content as %q\n", absPath, fpath)
-								}
-								if *flHardlink && ok { // Only proceed if we have sysStat
-									// Check if both files are on the same device before hardlinking
-									var targetSysStat syscall.Stat_t
-									targetInfo, err := os.Stat(fpath)
-									if err == nil && targetInfo != nil {
-										if targetSys, ok := targetInfo.Sys().(*syscall.Stat_t); ok {
-											targetSysStat = *targetSys
-											// Extract major device numbers
-											targetMajorDev := (targetSysStat.Dev >> 8) & 0xff | ((targetSysStat.Dev >> 32) & 0xfff00)
-											// Only hardlink if both files are on the same device
-											if currentMajorDev == targetMajorDev {
-												// Check if both files are within allowed paths (if specified)
-												if isPathAllowed(absPath, allowedHardlinkPaths) && isPathAllowed(fpath, allowedHardlinkPaths) {
-													if err = SafeLink(fpath, absPath, true); err != nil {
-														fmt.Fprintln(os.Stderr, err, absPath)
-														return
-													}
-													fmt.Printf("hard linked %q to %q\n", absPath, fpath)
-												} else {
-													if *flVerbose {
-														fmt.Printf("Skipped hardlink: file(s) not in allowed paths (current: %s, target: %s)\n",
-															absPath, fpath)
-													}
-												}
-											} else {
-												if *flVerbose {
-													fmt.Printf("Skipped hardlink: files on different devices (%d vs %d)\n",
-														int(currentMajorDev), int(targetMajorDev))
-												}
-											}
-										}
-									} else {
-										// If we can't get target stats, skip hardlinking
-										if *flVerbose {
-											fmt.Printf("Skipped hardlink: could not stat target file %s\n", fpath)
-										}
-									}
-								} else if *flHardlink && !ok {
-									// If we couldn't get device info, skip hardlinking
-									if *flVerbose {
-										fmt.Printf("Skipped hardlink: could not get device info for %s\n", absPath)
-									}
-								}
-								if *flSymlink {
-									if err = SafeLink(fpath, absPath, false); err != nil {
-										fmt.Fprintln(os.Stderr, err, absPath)
-										return
-									}
-									fmt.Printf("soft linked %q to %q\n", absPath, fpath)
-								}
-								savings += info.Size()
-							} else {
-								found[existingHash] = absPath
-							}
-
-							// Update the checked_time in the database
-							_, err = db.Exec("UPDATE file_hashes SET checked_time = CURRENT_TIMESTAMP WHERE file_path = ?", absPath)
-							if err != nil && *flVerbose {
-								fmt.Fprintf(os.Stderr, "Warning: could not update checked_time for %s: %v\n", absPath, err)
-							}
-							return
-						} else {
-							if *flVerbose {
-								fmt.Printf("File size changed: %s (%d -> %d bytes)\n",
-									absPath, existingSize, info.Size())
-							}
-						}
-					}
-				}
-
-				// Calculate hash for new or changed file
-				fh, err := os.Open(path)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err, path)
-					return
-				}
-				defer fh.Close()
-
-				h := sha1.New()
-				if _, err = io.Copy(h, fh); err != nil {
-					fmt.Fprintln(os.Stderr, err, path)
-					return
-				}
-				sum := fmt.Sprintf("%x", h.Sum(nil))
-
-				if *flVerbose {
-					fmt.Printf("SHA1(%s)= %s\n", absPath, sum)
-				}
-
-				mu.Lock()
-				defer mu.Unlock()
-				if fpath, ok := found[sum]; ok && fpath != absPath {
-					if !(*flQuiet) {
-						fmt.Printf("%q is the same content as %q\n", absPath, fpath)
-					}
-					if *flHardlink {
-						// Check if both files are on the same device before hardlinking
-						var targetSysStat syscall.Stat_t
-						targetInfo, err := os.Stat(fpath)
-						if err == nil && targetInfo != nil {
-							if targetSys, ok := targetInfo.Sys().(*syscall.Stat_t); ok {
-								targetSysStat = *targetSys
-								sysStat, ok := info.Sys().(*syscall.Stat_t)
-								if ok {
-									// Extract major device numbers
-									currentMajorDev := (sysStat.Dev >> 8) & 0xff | ((sysStat.Dev >> 32) & 0xfff00)
-									targetMajorDev := (targetSysStat.Dev >> 8) & 0xff | ((targetSysStat.Dev >> 32) & 0xfff00)
-									// Only hardlink if both files are on the same device
-									if currentMajorDev == targetMajorDev {
-										// Check if both files are within allowed paths (if specified)
-										if isPathAllowed(absPath, allowedHardlinkPaths) && isPathAllowed(fpath, allowedHardlinkPaths) {
-											if err = SafeLink(fpath, absPath, true); err != nil {
-												fmt.Fprintln(os.Stderr, err, absPath)
-												return
-											}
-											fmt.Printf("hard linked %q to %q\n", absPath, fpath)
-										} else {
-											if *flVerbose {
-												fmt.Printf("Skipped hardlink: file(s) not in allowed paths (current: %s, target: %s)\n",
-													absPath, fpath)
-											}
-										}
-									} else {
-										if *flVerbose {
-											fmt.Printf("Skipped hardlink: files on different devices (%d vs %d)\n",
-												int(currentMajorDev), int(targetMajorDev))
-										}
-									}
-								} else {
-									// If we can't get current file stats, skip hardlinking
-									if *flVerbose {
-										fmt.Printf("Skipped hardlink: could not get device info for %s\n", absPath)
-									}
-								}
-							} else {
-								// If we can't get target stats, skip hardlinking
-								if *flVerbose {
-									fmt.Printf("Skipped hardlink: could not get device info for target file %s\n", fpath)
-								}
-							}
-						} else {
-							// If we can't stat target file, skip hardlinking
-							if *flVerbose {
-								fmt.Printf("Skipped hardlink: could not stat target file %s\n", fpath)
-							}
-						}
-					}
-					if *flSymlink {
-						if err = SafeLink(fpath, absPath, false); err != nil {
-							fmt.Fprintln(os.Stderr, err, absPath)
-							return
-						}
-						fmt.Printf("soft linked %q to %q\n", absPath, fpath)
-					}
-					savings += info.Size()
-				} else {
-					found[sum] = absPath
-				}
-
-				// Send measurement to database if DB is provided
-				if db != nil {
-					measurements <- measurement{
-						hash: sum,
-						path: absPath,
-						size: info.Size(),
-					}
-				}
-			}()
-			return nil
-		})
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
+func readGroups(path string) ([]dups.Group, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return dups.ReadGroups(fh)
+}
 
-		// Wait for all workers to finish
-		wgWorkers.Wait()
+// writeGroups saves every file of st to path, grouped by hash
+func writeGroups(path string, st dups.Store) error {
+	groups, err := dups.Groups(st)
+	if err != nil {
+		return err
+	}
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = dups.WriteGroups(fh, groups); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
 
-		// Close the measurements channel and wait for DB writer to finish
-		if db != nil {
-			close(measurements)
-			wgDB.Wait()
-		}
-		fmt.Printf("Savings of %fmb\n", float64(savings)/1024.0/1024.0)
+func importJSON(jsonPath, dbPath string) {
+	db, err := dups.OpenSQLite(dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
 
-		// Only write the JSON file if the -o flag is specified with a non-empty value
-		if *flSaveMap != "" {
-			fh, err := os.Create(*flSaveMap)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
-			buf, err := json.Marshal(found)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
-			_, err = fh.Write(buf)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
-			fh.Close()
-			fmt.Fprintf(os.Stderr, "wrote %q\n", fh.Name())
-		}
+	// Load the JSON file
+	groups, err := readGroups(jsonPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading JSON file:", err)
+		os.Exit(1)
 	}
+
+	count, err := db.ImportGroups(groups)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error importing records:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully imported %d records from %s into database %s\n", count, jsonPath, dbPath)
 }
 
-// SafeLink overrides newname if it already exists. If there is an error in creating the link, the transaction is rolled back
-func SafeLink(oldname, newname string, hard bool) error {
-	var backupName string
-	// check if newname exists
-	if fi, err := os.Stat(newname); err == nil && fi != nil {
-		// make a random name
-		buf := make([]byte, 5)
-		if _, err = rand.Read(buf); err != nil {
-			return err
-		}
-		backupName = fmt.Sprintf("%s.%x", newname, buf)
-		// move newname to the random name backupName
-		if err = os.Rename(newname, backupName); err != nil {
-			return err
-		}
+func exportJSON(dbPath, jsonPath string) {
+	db, err := dups.OpenSQLite(dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
 	}
-	if hard {
-		// hardlink oldname to newname
-		if err := os.Link(oldname, newname); err != nil {
-			// if that failed, and there is a backupName
-			if len(backupName) > 0 {
-				// then move back the backup
-				if err = os.Rename(backupName, newname); err != nil {
-					return err
-				}
-			}
-			return err
-		}
-	} else {
-		// symlink
-		relpath, err := filepath.Rel(filepath.Dir(newname), oldname)
-		if err != nil {
-			return err
-		}
-		if err := os.Symlink(relpath, newname); err != nil {
-			// if that failed, and there is a backupName
-			if len(backupName) > 0 {
-				// then move back the backup
-				if err = os.Rename(backupName, newname); err != nil {
-					return err
-				}
-			}
-			return err
-		}
+	defer db.Close()
+
+	groups, err := dups.Groups(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
 	}
-	// remove the backupName
-	if len(backupName) > 0 {
-		os.Remove(backupName)
+
+	// Write the groups to the JSON file
+	jsonFile, err := os.Create(jsonPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating JSON file:", err)
+		os.Exit(1)
 	}
-	return nil
+	defer jsonFile.Close()
+
+	if err = dups.WriteGroups(jsonFile, groups); err != nil {
+		fmt.Fprintln(os.Stderr, "Error encoding JSON:", err)
+		os.Exit(1)
+	}
+
+	count := 0
+	for _, g := range groups {
+		count += len(g.Files)
+	}
+	fmt.Printf("Successfully exported %d records from database %s to %s\n", count, dbPath, jsonPath)
 }
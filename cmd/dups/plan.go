@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// applyPlan takes the actions of the plan file at path, reporting those whose
+// files changed since it was made. Files are trashed to trashDir, and their
+// moves recorded in the database at dbPath.
+func applyPlan(path, trashDir, dbPath string, allowedHardlinkPaths []string, ignoreAttributes []dups.Attribute, journal *dups.Journal) {
+	fh, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	plan, err := dups.ReadPlan(fh)
+	fh.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading plan:", err)
+		os.Exit(1)
+	}
+
+	linker := &dups.Linker{AllowedPaths: allowedHardlinkPaths, IgnoreAttributes: ignoreAttributes, Journal: journal}
+	trashes := false
+	for _, a := range plan.Actions {
+		trashes = trashes || a.Op == dups.OpTrash
+	}
+	var db *dups.SQLiteStore
+	if trashes {
+		if trashDir == "" || dbPath == "" {
+			fmt.Fprintln(os.Stderr, "Error: the plan trashes files, which requires -trash and -db to be specified")
+			os.Exit(1)
+		}
+		if linker.Trash, err = dups.NewTrash(trashDir); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		if db, err = dups.OpenSQLite(dbPath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		linker.Recorder = db
+		fmt.Fprintf(os.Stderr, "moving duplicates to %q, as run %s\n", linker.Trash.Dir, linker.Trash.Run)
+	}
+	var applied, changed, failed int
+	savings := int64(0)
+	for _, a := range plan.Actions {
+		err := linker.Apply(a)
+		switch err.(type) {
+		case nil:
+			applied++
+			savings += a.Size
+			if *flQuiet {
+				break
+			}
+			if a.Op == dups.OpTrash {
+				fmt.Printf("trashed %q, the same content as %q\n", a.Path, a.Target)
+			} else {
+				fmt.Printf("%s %q to %q\n", a.Op, a.Path, a.Target)
+			}
+		case *dups.ChangedError:
+			changed++
+			fmt.Fprintln(os.Stderr, "CHANGED", err)
+		case *dups.SkipError, *dups.MismatchError:
+			failed++
+			fmt.Fprintf(os.Stderr, "Skipped %s of %q: %s\n", a.Op, a.Path, err)
+		default:
+			failed++
+			fmt.Fprintln(os.Stderr, err, a.Path)
+		}
+	}
+	fmt.Printf("Applied %d of %d actions (%d changed, %d failed), savings of %fmb\n",
+		applied, len(plan.Actions), changed, failed, float64(savings)/1024.0/1024.0)
+	if changed > 0 || failed > 0 {
+		if db != nil {
+			db.Close()
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runReport prints the duplicate groups of a database or JSON map, the most
+// reclaimable bytes first
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	flDB := fs.String("db", "", "sqlite3 database file to report on")
+	flLoadMap := fs.String("l", "", "JSON map file to report on")
+	flJSON := fs.Bool("json", false, "output the duplicate groups as JSON")
+	flSimilar := fs.String("similar", "", fmt.Sprintf("report the images that look alike by the perceptual hash recorded by a scan with -similar (%s) instead (requires -db)", imageAlgorithmNames()))
+	flSimilarDist := fs.Int("similar-distance", dups.DefaultSimilarDistance, "the number of bits the perceptual hashes of similar images may differ by")
+	fs.Parse(args)
+
+	if *flSimilar != "" {
+		reportSimilar(*flDB, *flSimilar, *flSimilarDist, *flJSON)
+		return
+	}
+
+	var store dups.Store
+	switch {
+	case *flDB != "":
+		db, err := dups.OpenSQLite(*flDB)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening database:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		store = db
+	case *flLoadMap != "":
+		groups, err := readGroups(*flLoadMap)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		store = dups.NewMapStoreFromGroups(groups)
+	default:
+		fmt.Fprintln(os.Stderr, "Error: report requires -db or -l to be specified")
+		os.Exit(1)
+	}
+
+	groups, err := dups.DuplicateGroups(store)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
+	}
+
+	if *flJSON {
+		// a list rather than a map of hash, to keep the order of the groups
+		records := make([]dups.GroupRecord, 0, len(groups))
+		for _, g := range groups {
+			records = append(records, dups.NewGroupRecord(g))
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(records); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	total := int64(0)
+	for _, g := range groups {
+		fmt.Printf("%s: %d copies of %d bytes, %fmb reclaimable\n",
+			g.Hash, g.Copies(), g.Size(), float64(g.Reclaimable())/1024.0/1024.0)
+		for _, e := range g.Files {
+			fmt.Printf("\t%s\n", e.Path)
+		}
+		total += g.Reclaimable()
+	}
+	fmt.Printf("%d duplicate groups, %fmb reclaimable\n", len(groups), float64(total)/1024.0/1024.0)
+}
+
+// reportSimilar prints the groups of similar images of the database at
+// dbPath
+func reportSimilar(dbPath, algorithm string, maxDistance int, asJSON bool) {
+	alg, err := dups.ParseImageAlgorithm(algorithm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if dbPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: report -similar requires -db to be specified")
+		os.Exit(1)
+	}
+	db, err := dups.OpenSQLite(dbPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	images, err := db.Images(alg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
+	}
+	groups := dups.GroupSimilar(images, maxDistance)
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(groups); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	printSimilar(groups, maxDistance)
+}
+
+// printSimilar lists the groups of similar images, with the distance of each
+// to the first of its group
+func printSimilar(groups []dups.SimilarGroup, maxDistance int) {
+	fmt.Printf("%d groups of similar images, within %d bits (not linked):\n", len(groups), maxDistance)
+	for _, g := range groups {
+		fmt.Printf("%s: %d images\n", g.Files[0].Hash, len(g.Files))
+		for i, e := range g.Files {
+			fmt.Printf("\t%s (distance %d)\n", e.Path, g.Distances[i])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runRestore moves the files of a -trash run back to where they were
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	flDB := fs.String("db", "", "sqlite3 database file the run was recorded in")
+	flRun := fs.String("run", "", "the run to restore (defaults to the latest)")
+	flList := fs.Bool("list", false, "list the runs with files in the trash")
+	flDryRun := fs.Bool("n", false, "only list the files that would be restored")
+	flQuiet := fs.Bool("q", false, "less output")
+	fs.Parse(args)
+	if *flDB == "" {
+		fmt.Fprintln(os.Stderr, "Error: restore requires -db to be specified")
+		os.Exit(1)
+	}
+	db, err := dups.OpenSQLite(*flDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	runs, err := db.TrashRuns()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
+	}
+	if *flList {
+		for _, r := range runs {
+			fmt.Printf("%s: %d files, %fmb, moved %s\n",
+				r.Run, r.Files, float64(r.Bytes)/1024.0/1024.0, r.Moved.Local().Format(time.RFC3339))
+		}
+		return
+	}
+	run := *flRun
+	if run == "" {
+		if len(runs) == 0 {
+			fmt.Println("No files in the trash")
+			return
+		}
+		run = runs[0].Run
+	}
+	files, err := db.Trashed(run)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error querying database:", err)
+		os.Exit(1)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no files in the trash of run %q\n", run)
+		os.Exit(1)
+	}
+
+	var restored, failed int
+	for _, f := range files {
+		if *flDryRun {
+			fmt.Printf("%q from %q\n", f.Path, f.TrashPath)
+			continue
+		}
+		if err := f.Restore(); err != nil {
+			// including a file changed in the trash, which is left there
+			failed++
+			fmt.Fprintf(os.Stderr, "Skipped restoring %q: %s\n", f.Path, err)
+			continue
+		}
+		if err := db.DropTrashed(f.ID); err != nil {
+			fmt.Fprintln(os.Stderr, "Error updating database:", err)
+			os.Exit(1)
+		}
+		restored++
+		if !*flQuiet {
+			fmt.Printf("restored %q\n", f.Path)
+		}
+	}
+	if *flDryRun {
+		fmt.Printf("Would restore %d files of run %s\n", len(files), run)
+		return
+	}
+	fmt.Printf("Restored %d of %d files of run %s (%d failed)\n", restored, len(files), run, failed)
+	if failed > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
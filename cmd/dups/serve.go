@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runServe answers queries of a database over HTTP, until interrupted
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	flDB := fs.String("db", "", "sqlite3 database file to serve")
+	flAddr := fs.String("addr", "localhost:8080", "address to listen on")
+	fs.Parse(args)
+	if *flDB == "" {
+		fmt.Fprintln(os.Stderr, "Error: serve requires -db to be specified")
+		os.Exit(1)
+	}
+	db, err := dups.OpenSQLiteReadOnly(*flDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	server := &http.Server{
+		Addr:              *flAddr,
+		Handler:           dups.NewServer(db),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	fmt.Fprintf(os.Stderr, "serving %s on http://%s\n", *flDB, *flAddr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// writeSummary writes the statistics of a scan, as "text" or "json"
+func writeSummary(w io.Writer, format string, st dups.Stats) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(st)
+	}
+	mb := func(n int64) float64 { return float64(n) / 1024.0 / 1024.0 }
+	fmt.Fprintf(w, "Files seen:       %d (%fmb), %d filtered out\n", st.FilesSeen, mb(st.BytesSeen), st.FilesFiltered)
+	fmt.Fprintf(w, "Files hashed:     %d (%fmb)\n", st.FilesHashed, mb(st.BytesHashed))
+	fmt.Fprintf(w, "Cache hits:       %d\n", st.CacheHits)
+	if st.MembersHashed > 0 {
+		fmt.Fprintf(w, "Members hashed:   %d\n", st.MembersHashed)
+	}
+	if st.ImagesHashed > 0 {
+		fmt.Fprintf(w, "Images hashed:    %d\n", st.ImagesHashed)
+	}
+	fmt.Fprintf(w, "Duplicate groups: %d\n", st.Groups)
+	fmt.Fprintf(w, "Reclaimable:      %fmb\n", mb(st.BytesReclaimable))
+	fmt.Fprintf(w, "Reclaimed:        %fmb\n", mb(st.BytesReclaimed))
+	kinds := make([]string, 0, len(st.Errors))
+	total := int64(0)
+	for kind, n := range st.Errors {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(w, "Errors:           %d\n", total)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-15s %d\n", kind+":", st.Errors[kind])
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vbatts/utils/pkg/dups"
+)
+
+// runUndo breaks the links recorded in a journal back into independent copies
+func runUndo(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	flJournal := fs.String("journal", "", "journal file written by -journal")
+	flRun := fs.String("run", "", "only undo the links of this run")
+	flList := fs.Bool("list", false, "list the links that are not undone, by run")
+	flDryRun := fs.Bool("n", false, "only list the links that would be undone")
+	flQuiet := fs.Bool("q", false, "less output")
+	fs.Parse(args)
+	if *flJournal == "" {
+		fmt.Fprintln(os.Stderr, "Error: undo requires -journal to be specified")
+		os.Exit(1)
+	}
+	fh, err := os.Open(*flJournal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	entries, err := dups.ReadJournal(fh)
+	fh.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading journal:", err)
+		os.Exit(1)
+	}
+	links := dups.Undoable(entries, *flRun)
+
+	if *flList || *flDryRun {
+		for _, e := range links {
+			fmt.Printf("%s %s %s %q to %q\n", e.Run, e.Time.Format("2006-01-02T15:04:05Z07:00"), e.Op, e.Path, e.Target)
+		}
+		fmt.Printf("%d links to undo\n", len(links))
+		return
+	}
+
+	journal, err := dups.OpenJournal(*flJournal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening journal:", err)
+		os.Exit(1)
+	}
+	defer journal.Close()
+	var undone, changed, failed int
+	for _, e := range links {
+		err := e.Undo()
+		switch err.(type) {
+		case nil:
+		case *dups.ChangedError:
+			changed++
+			fmt.Fprintln(os.Stderr, "CHANGED", err)
+			continue
+		case *dups.SkipError:
+			failed++
+			fmt.Fprintf(os.Stderr, "Skipped undoing %s of %q: %s\n", e.Op, e.Path, err)
+			continue
+		default:
+			failed++
+			fmt.Fprintln(os.Stderr, err, e.Path)
+			continue
+		}
+		err = journal.Append(dups.JournalEntry{Op: dups.OpUndo, Path: e.Path, Target: e.Target, Hash: e.Hash, Size: e.Size})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing journal:", err)
+			os.Exit(1)
+		}
+		undone++
+		if !*flQuiet {
+			fmt.Printf("undid %s %q to %q\n", e.Op, e.Path, e.Target)
+		}
+	}
+	fmt.Printf("Undid %d of %d links (%d changed, %d failed)\n", undone, len(links), changed, failed)
+	if changed > 0 || failed > 0 {
+		journal.Close()
+		os.Exit(1)
+	}
+}
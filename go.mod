@@ -4,6 +4,7 @@ go 1.21
 
 require (
 	github.com/BurntSushi/toml v1.3.2
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/go-git/go-git/v5 v5.13.0
 	github.com/luksen/maildir v0.0.0-20210101204218-7ed7afdce6bf
 	github.com/mattn/go-gtk v0.0.0-20240119050609-48574e312fac // indirect
@@ -11,6 +12,8 @@ require (
 	github.com/mqu/go-notify v0.0.0-20130719194048-ef6f6f49d093
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
 	gopkg.in/fsnotify.v1 v1.4.7
 )
 
@@ -19,8 +22,6 @@ require (
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/go-git/gcfg v1.5.1-0.20230307220236-3a3c6141e376 // indirect
 	github.com/go-git/go-billy/v5 v5.6.0 // indirect
-	github.com/mattn/go-gtk v0.0.0-20240119050609-48574e312fac // indirect
 	github.com/pjbgf/sha1cd v0.3.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
@@ -0,0 +1,170 @@
+package dups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveSep separates the path of an archive from the name of a member in
+// it, in the virtual paths of archive members like "foo.tar.gz!/dir/file"
+const ArchiveSep = "!/"
+
+// archiveExts are the suffixes of the archives whose members are hashed
+var archiveExts = []string{".tar", ".tar.gz", ".tgz", ".zip"}
+
+// isArchive reports whether path is named like a tar or zip archive
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemberPath is the virtual path of the member name of the archive at path
+func MemberPath(archive, name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return archive + ArchiveSep + name
+}
+
+// SplitMemberPath splits the virtual path of an archive member into the path
+// of the archive and the name of the member. ok is false for the paths of
+// files.
+func SplitMemberPath(p string) (archive, name string, ok bool) {
+	for i := strings.Index(p, ArchiveSep); i >= 0; {
+		if isArchive(p[:i]) {
+			return p[:i], p[i+len(ArchiveSep):], true
+		}
+		j := strings.Index(p[i+1:], ArchiveSep)
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return p, "", false
+}
+
+// IsArchiveMember reports whether p is the virtual path of an archive member
+func IsArchiveMember(p string) bool {
+	_, _, ok := SplitMemberPath(p)
+	return ok
+}
+
+// readArchive calls fn for each regular file in the archive at path, with
+// its content
+func readArchive(ctx context.Context, path string, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.Name, err)
+			}
+			err = fn(f.Name, f.FileInfo(), contextReader{ctx, rc})
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var r io.Reader = fh
+	if !strings.HasSuffix(lower, ".tar") {
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(contextReader{ctx, r})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err = fn(hdr.Name, hdr.FileInfo(), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archive hashes the members of the archive at path, whose stat info is info,
+// and sends them to the aggregator. Archives are read again on each scan, as
+// their members are only known once read.
+func (r *scanRun) archive(path string, info os.FileInfo) {
+	s := r.s
+	err := readArchive(r.ctx, path, func(name string, memberInfo os.FileInfo, content io.Reader) error {
+		h, err := s.algorithm().New()
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(h, content); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		s.count(func(st *Stats) {
+			st.MembersHashed++
+			st.BytesHashed += memberInfo.Size()
+		})
+		sum := s.algorithm().Digest(h.Sum(nil))
+		m := &member{path: MemberPath(path, name), info: memberInfo, archive: info, seen: true, hashed: true}
+		if s.Verbose {
+			alg, hex := SplitDigest(sum)
+			fmt.Fprintf(s.Stdout, "%s(%s)= %s\n", strings.ToUpper(string(alg)), m.path, hex)
+		}
+		r.see(sum, m)
+		return nil
+	})
+	if err != nil && r.ctx.Err() == nil {
+		s.fail("read", path, err)
+	}
+}
+
+// memberChanged is why the record e of a member of the archive at path is
+// stale, or "" when it is not. Records of members have the device, inode and
+// ctime of their archive.
+func memberChanged(archive string, e Entry) string {
+	info, err := os.Stat(archive)
+	if err != nil {
+		return err.Error()
+	}
+	cur := NewEntry(archive, "", info)
+	switch {
+	case !e.CTime.Equal(cur.CTime):
+		return fmt.Sprintf("archive changed ctime %s -> %s", e.CTime, cur.CTime)
+	case e.Inode != cur.Inode:
+		return fmt.Sprintf("archive changed inode %d -> %d", e.Inode, cur.Inode)
+	case e.DeviceID != cur.DeviceID:
+		return fmt.Sprintf("archive changed device %s -> %s", e.DeviceID, cur.DeviceID)
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+package dups
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tarOf returns a tar archive of files, gzipped when gz is set
+func tarOf(t *testing.T, files map[string]string, gz bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var zw *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	}
+	for _, name := range sortedNames(files) {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory, which is not a member hashed
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// zipOf returns a zip archive of files
+func zipOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range sortedNames(files) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sortedNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSplitMemberPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, archive, name string
+		ok                  bool
+	}{
+		{"/t/a.tar!/x", "/t/a.tar", "x", true},
+		{"/t/a.TGZ!/d/x", "/t/a.TGZ", "d/x", true},
+		// the outer archive, of a member that is an archive itself
+		{"/t/a.zip!/b.tar!/x", "/t/a.zip", "b.tar!/x", true},
+		// a directory named like that is not an archive
+		{"/t/not!/a.tar!/x", "/t/not!/a.tar", "x", true},
+		{"/t/a.txt!/x", "/t/a.txt!/x", "", false},
+		{"/t/a.tar", "/t/a.tar", "", false},
+	} {
+		archive, name, ok := SplitMemberPath(tc.path)
+		if archive != tc.archive || name != tc.name || ok != tc.ok {
+			t.Errorf("SplitMemberPath(%q) = %q, %q, %v, want %q, %q, %v", tc.path, archive, name, ok, tc.archive, tc.name, tc.ok)
+		}
+	}
+	if got := MemberPath("/t/a.tar", "./d/../x"); got != "/t/a.tar!/x" {
+		t.Errorf("MemberPath = %q", got)
+	}
+}
+
+func TestScanArchives(t *testing.T) {
+	root := t.TempDir()
+	inner := tarOf(t, map[string]string{"x": "dup"}, false)
+	writeFiles(t, root, map[string]string{
+		"loose":    "dup",
+		"copy":     "dup",
+		"a.tar":    string(tarOf(t, map[string]string{"x": "dup", "d/y": "dup", "z": "other"}, false)),
+		"b.tar.gz": string(tarOf(t, map[string]string{"x": "dup"}, true)),
+		"c.zip":    string(zipOf(t, map[string]string{"x": "dup", "inner.tar": string(inner)})),
+		// the same content as the member of c.zip alone
+		"inner.tar": string(inner),
+	})
+	before := map[string]os.FileInfo{}
+	for _, name := range []string{"a.tar", "b.tar.gz", "c.zip", "inner.tar"} {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[name] = info
+	}
+
+	store := NewMapStore()
+	s := newTestScanner(store)
+	var out bytes.Buffer
+	s.Stdout = &out
+	s.Archives = true
+	s.Linker = &Linker{Hard: true}
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	var members []string
+	store.Each(func(e Entry) error {
+		if IsArchiveMember(e.Path) {
+			rel, _ := filepath.Rel(root, e.Path)
+			members = append(members, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(members)
+	// the members of nested archives are not read, the archive member is
+	// hashed as a whole
+	want := []string{"a.tar!/d/y", "a.tar!/x", "a.tar!/z", "b.tar.gz!/x", "c.zip!/inner.tar", "c.zip!/x", "inner.tar!/x"}
+	if strings.Join(members, " ") != strings.Join(want, " ") {
+		t.Errorf("members recorded %q, want %q", members, want)
+	}
+	if st := s.Stats(); st.MembersHashed != int64(len(want)) {
+		t.Errorf("%d members hashed, want %d", st.MembersHashed, len(want))
+	}
+
+	// members are reported, but never replaced nor linked to
+	loose, _ := os.Stat(filepath.Join(root, "loose"))
+	if cp, _ := os.Stat(filepath.Join(root, "copy")); !os.SameFile(loose, cp) {
+		t.Error("the loose copy was not linked")
+	}
+	for name, info := range before {
+		after, err := os.Stat(filepath.Join(root, name))
+		if err != nil || !os.SameFile(info, after) || !after.ModTime().Equal(info.ModTime()) {
+			t.Errorf("archive %s was changed by the scan: %v", name, err)
+		}
+	}
+	for _, target := range s.Found() {
+		if IsArchiveMember(target) {
+			t.Errorf("member %s kept, for files to be linked to", target)
+		}
+	}
+	for _, line := range []string{
+		`archive member "` + filepath.Join(root, "a.tar") + `!/d/y" is the same content as "` + filepath.Join(root, "copy") + `"`,
+		`archive member "` + filepath.Join(root, "c.zip") + `!/inner.tar" is the same content as "` + filepath.Join(root, "inner.tar") + `"`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("no %s in the report:\n%s", line, out.String())
+		}
+	}
+
+	// nor is a later file of the content of a member alone linked to it
+	writeFiles(t, root, map[string]string{"late": "other"})
+	late, _ := os.Stat(filepath.Join(root, "late"))
+	s = newTestScanner(store)
+	out.Reset()
+	s.Stdout = &out
+	s.Archives = true
+	s.Linker = &Linker{Hard: true}
+	if err := s.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.Lstat(filepath.Join(root, "late")); err != nil || !os.SameFile(late, after) {
+		t.Errorf("the file of the content of a member was replaced: %v", err)
+	}
+	line := `archive member "` + filepath.Join(root, "a.tar") + `!/z" is the same content as "` + filepath.Join(root, "late") + `"`
+	if !strings.Contains(out.String(), line) {
+		t.Errorf("no %s in the report:\n%s", line, out.String())
+	}
+}
@@ -0,0 +1,423 @@
+package dups
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ChunkParams are the bounds of the size of content-defined chunks, in bytes.
+// Avg is rounded down to a power of two.
+type ChunkParams struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// DefaultChunkParams are the chunk sizes used when none are set, in the
+// range of those of block-level backup and dedupe tools
+var DefaultChunkParams = ChunkParams{Min: 16 << 10, Avg: 64 << 10, Max: 256 << 10}
+
+func (p ChunkParams) String() string {
+	return fmt.Sprintf("%d-%d-%d", p.Min, p.Avg, p.Max)
+}
+
+// Validate checks that the sizes are in order
+func (p ChunkParams) Validate() error {
+	if p.Min < 64 || p.Avg < p.Min || p.Max < p.Avg {
+		return fmt.Errorf("bad chunk sizes %s: want 64 <= min <= avg <= max", p)
+	}
+	return nil
+}
+
+// mask has a chunk end where the high bits of the rolling hash are all 0,
+// once every Avg bytes on average
+func (p ChunkParams) mask() uint64 {
+	n := bits.Len(uint(p.Avg)) - 1
+	return ^uint64(0) << uint(64-n)
+}
+
+// Chunk is a content-defined piece of a file
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+// gear are the random values of each byte in the rolling hash
+var gear = func() (table [256]uint64) {
+	// splitmix64, from a fixed seed so that chunks are the same everywhere
+	x := uint64(0x6475707363686e6b)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkHash is the digest of the content of a chunk, of 128 bits
+func chunkHash(data []byte) string {
+	h, _ := blake2b.New(16, nil)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SplitChunks splits the content of r into chunks, with a gear rolling hash
+// of the last 64 bytes deciding where they end, so that inserting or removing
+// data only changes the chunks around it. fn is called for each chunk in
+// turn.
+func SplitChunks(r io.Reader, p ChunkParams, fn func(Chunk) error) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	mask := p.mask()
+	var (
+		buf    = make([]byte, 1<<20)
+		chunk  = make([]byte, 0, p.Max)
+		hash   uint64
+		offset int64
+	)
+	cut := func() error {
+		c := Chunk{Offset: offset, Size: int64(len(chunk)), Hash: chunkHash(chunk)}
+		offset += c.Size
+		chunk, hash = chunk[:0], 0
+		return fn(c)
+	}
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			chunk = append(chunk, b)
+			hash = (hash << 1) + gear[b]
+			if len(chunk) >= p.Max || (len(chunk) >= p.Min && hash&mask == 0) {
+				if err := cut(); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(chunk) > 0 {
+		return cut()
+	}
+	return nil
+}
+
+// ChunkFile returns the chunks of the file at path
+func ChunkFile(ctx context.Context, path string, p ChunkParams) ([]Chunk, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var chunks []Chunk
+	err = SplitChunks(contextReader{ctx: ctx, r: fh}, p, func(c Chunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	return chunks, err
+}
+
+// ChunkedFile is the record of the chunks of a file
+type ChunkedFile struct {
+	Path    string
+	Params  ChunkParams
+	Size    int64
+	ModTime time.Time
+	CTime   time.Time
+	Chunks  []Chunk
+}
+
+// ChunkStore is implemented by the Stores that keep the chunks of files
+type ChunkStore interface {
+	// GetChunks returns the record of the chunks of path of params p. ok is
+	// false when there is none.
+	GetChunks(path string, p ChunkParams) (f ChunkedFile, ok bool, err error)
+	// PutChunks records f, replacing any existing record for its path and
+	// params
+	PutChunks(f ChunkedFile) error
+}
+
+// ChunkAnalyzer is implemented by the ChunkStores that sum up the chunks they
+// keep themselves, for a ChunkScanner to not hold them all in memory
+type ChunkAnalyzer interface {
+	// AnalyzeChunks is the ChunkAnalysis of the recorded chunks of params p
+	// of the files at paths, as ChunkScanner.Analyze makes it
+	AnalyzeChunks(paths []string, p ChunkParams, top int) (ChunkAnalysis, error)
+}
+
+// ChunkScanner splits the files of directory trees into content-defined
+// chunks, to analyze how much of their content a block-level dedupe would
+// share
+type ChunkScanner struct {
+	// Store, if it is a ChunkStore, is used to skip chunking the files
+	// already recorded, and to record the others. If it is a ChunkAnalyzer
+	// too, it sums up their chunks, and the files whose chunks it fails to
+	// record are left out. The errors are recorded if it is an
+	// ErrorRecorder.
+	Store Store
+	// Filter, if set, selects the files that are chunked
+	Filter *Filter
+	// Params are the chunk sizes, which default to DefaultChunkParams
+	Params ChunkParams
+	// Workers is the number of files chunked concurrently
+	Workers int
+	// Verbose reports each file chunked
+	Verbose bool
+	// Stdout and Stderr receive the report and the errors. They default to
+	// os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	mu     sync.Mutex
+	files  map[string][]Chunk
+	errors []*ScanError
+}
+
+// NewChunkScanner returns a ChunkScanner using store, which may be nil
+func NewChunkScanner(store Store) *ChunkScanner {
+	return &ChunkScanner{
+		Store:   store,
+		Params:  DefaultChunkParams,
+		Workers: 1,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		files:   map[string][]Chunk{},
+	}
+}
+
+// Scan chunks the files under root, until ctx is done
+func (c *ChunkScanner) Scan(ctx context.Context, root string) error {
+	if err := c.Params.Validate(); err != nil {
+		return err
+	}
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				c.chunk(ctx, path)
+			}
+		}()
+	}
+	walker := &Scanner{Filter: c.Filter}
+	err := walker.walkFiltered(ctx, root, func(path string, info os.FileInfo) {
+		select {
+		case paths <- path:
+		case <-ctx.Done():
+		}
+	}, nil, func(path string, err error) {
+		c.fail("walk", path, err)
+	})
+	close(paths)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// chunk splits the file at path into chunks, unless its record in the Store
+// is still usable
+func (c *ChunkScanner) chunk(ctx context.Context, path string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		c.fail("read", path, err)
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		c.fail("read", absPath, err)
+		return
+	}
+	cur := NewEntry(absPath, "", info)
+	store, _ := c.Store.(ChunkStore)
+	if store != nil {
+		f, ok, err := store.GetChunks(absPath, c.Params)
+		if err != nil {
+			c.fail("store", absPath, err)
+		} else if ok && f.Size == cur.Size && f.ModTime.Equal(cur.ModTime) && f.CTime.Equal(cur.CTime) {
+			c.add(absPath, f.Chunks)
+			return
+		}
+	}
+	chunks, err := ChunkFile(ctx, absPath, c.Params)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.fail("read", absPath, err)
+		}
+		return
+	}
+	if c.Verbose {
+		fmt.Fprintf(c.Stdout, "%s: %d chunks\n", absPath, len(chunks))
+	}
+	if store != nil {
+		f := ChunkedFile{Path: absPath, Params: c.Params, Size: cur.Size, ModTime: cur.ModTime, CTime: cur.CTime, Chunks: chunks}
+		if err := store.PutChunks(f); err != nil {
+			c.fail("store", absPath, err)
+			if _, ok := c.Store.(ChunkAnalyzer); ok {
+				return
+			}
+		}
+	}
+	c.add(absPath, chunks)
+}
+
+// add keeps the chunks of path for Analyze, or only its path when the Store
+// sums them up
+func (c *ChunkScanner) add(path string, chunks []Chunk) {
+	if _, ok := c.Store.(ChunkAnalyzer); ok {
+		chunks = nil
+	}
+	c.mu.Lock()
+	c.files[path] = chunks
+	c.mu.Unlock()
+}
+
+// fail reports the error of op on path, keeps it for Errors, and records it
+// in the Store
+func (c *ChunkScanner) fail(op, path string, err error) {
+	e := newScanError(op, path, err)
+	fmt.Fprintln(c.Stderr, "Error:", err)
+	c.mu.Lock()
+	c.errors = append(c.errors, e)
+	c.mu.Unlock()
+
+	if recorder, ok := c.Store.(ErrorRecorder); ok {
+		if rerr := recorder.RecordError(e); rerr != nil {
+			fmt.Fprintln(c.Stderr, "Error recording error:", rerr)
+		}
+	}
+}
+
+// Errors returns the errors met by the scans so far
+func (c *ChunkScanner) Errors() []*ScanError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*ScanError(nil), c.errors...)
+}
+
+// MaxPairedFiles is the most files of a chunk for it to count toward the bytes
+// shared by their pairs. Chunks common to more files, like runs of zeros, would
+// pair every one of them with every other.
+const MaxPairedFiles = 100
+
+// ChunkPair is a pair of files sharing chunks
+type ChunkPair struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// Shared is the size of the distinct chunks both files have
+	Shared int64 `json:"shared"`
+}
+
+// ChunkAnalysis sums up how much content the files chunked share
+type ChunkAnalysis struct {
+	Params ChunkParams `json:"params"`
+	Files  int         `json:"files"`
+	Bytes  int64       `json:"bytes"`
+	Chunks int         `json:"chunks"`
+	// UniqueChunks and UniqueBytes count the distinct chunks, which are all
+	// a block-level dedupe would store
+	UniqueChunks int   `json:"unique_chunks"`
+	UniqueBytes  int64 `json:"unique_bytes"`
+	// Savings is what a block-level dedupe would save, Bytes - UniqueBytes
+	Savings int64 `json:"savings"`
+	// CommonChunks counts the distinct chunks of more than MaxPairedFiles
+	// files, which count toward UniqueBytes and Savings but not toward the
+	// bytes shared by Pairs
+	CommonChunks int `json:"common_chunks"`
+	// Pairs are the pairs of files sharing the most bytes, the most first
+	Pairs []ChunkPair `json:"pairs"`
+}
+
+// Analyze sums up the chunks of the files scanned so far, listing the top
+// pairs of files sharing the most bytes, or all of them when top is 0. The
+// chunks of more than MaxPairedFiles files are left out of the pairs.
+func (c *ChunkScanner) Analyze(top int) (ChunkAnalysis, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	paths := make([]string, 0, len(c.files))
+	for path := range c.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if analyzer, ok := c.Store.(ChunkAnalyzer); ok {
+		return analyzer.AnalyzeChunks(paths, c.Params, top)
+	}
+
+	a := ChunkAnalysis{Params: c.Params, Files: len(c.files), Pairs: []ChunkPair{}}
+	// the files of each distinct chunk, by index in paths
+	type chunkFiles struct {
+		size  int64
+		files []int
+	}
+	byHash := map[string]*chunkFiles{}
+	for i, path := range paths {
+		for _, ch := range c.files[path] {
+			a.Chunks++
+			a.Bytes += ch.Size
+			cf, ok := byHash[ch.Hash]
+			if !ok {
+				cf = &chunkFiles{size: ch.Size}
+				byHash[ch.Hash] = cf
+				a.UniqueChunks++
+				a.UniqueBytes += ch.Size
+			}
+			if n := len(cf.files); n == 0 || cf.files[n-1] != i {
+				cf.files = append(cf.files, i)
+			}
+		}
+	}
+	a.Savings = a.Bytes - a.UniqueBytes
+
+	shared := map[[2]int]int64{}
+	for _, cf := range byHash {
+		if len(cf.files) > MaxPairedFiles {
+			a.CommonChunks++
+			continue
+		}
+		for x := 0; x < len(cf.files); x++ {
+			for y := x + 1; y < len(cf.files); y++ {
+				shared[[2]int{cf.files[x], cf.files[y]}] += cf.size
+			}
+		}
+	}
+	for pair, size := range shared {
+		a.Pairs = append(a.Pairs, ChunkPair{A: paths[pair[0]], B: paths[pair[1]], Shared: size})
+	}
+	sort.Slice(a.Pairs, func(i, j int) bool {
+		if a.Pairs[i].Shared != a.Pairs[j].Shared {
+			return a.Pairs[i].Shared > a.Pairs[j].Shared
+		}
+		if a.Pairs[i].A != a.Pairs[j].A {
+			return a.Pairs[i].A < a.Pairs[j].A
+		}
+		return a.Pairs[i].B < a.Pairs[j].B
+	})
+	if top > 0 && len(a.Pairs) > top {
+		a.Pairs = a.Pairs[:top]
+	}
+	return a, nil
+}
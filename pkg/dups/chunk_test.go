@@ -0,0 +1,163 @@
+package dups
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeCommonChunks(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			c := NewChunkScanner(store)
+			// every file has the common chunk, and pairs share one of their own
+			files := MaxPairedFiles + 2
+			for i := 0; i < files; i++ {
+				f := ChunkedFile{Path: fmt.Sprintf("/f%03d", i), Params: c.Params, Chunks: []Chunk{
+					{Offset: 0, Size: 1000, Hash: "common"},
+					{Offset: 1000, Size: 10, Hash: fmt.Sprintf("pair%d", i/2)},
+				}}
+				if chunks, ok := store.(ChunkStore); ok {
+					if err := chunks.PutChunks(f); err != nil {
+						t.Fatal(err)
+					}
+				}
+				c.add(f.Path, f.Chunks)
+			}
+			a, err := c.Analyze(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Files != files || a.UniqueChunks != 1+files/2 || a.CommonChunks != 1 {
+				t.Errorf("%d files, %d distinct chunks, %d common, want %d, %d and 1",
+					a.Files, a.UniqueChunks, a.CommonChunks, files, 1+files/2)
+			}
+			if want := int64(files-1)*1000 + int64(files/2)*10; a.Savings != want {
+				t.Errorf("savings %d, want %d", a.Savings, want)
+			}
+			if len(a.Pairs) != files/2 {
+				t.Fatalf("%d pairs, want %d", len(a.Pairs), files/2)
+			}
+			for _, p := range a.Pairs {
+				if p.Shared != 10 {
+					t.Errorf("pair %+v, want 10 bytes shared", p)
+				}
+			}
+			if top, err := c.Analyze(3); err != nil || len(top.Pairs) != 3 {
+				t.Errorf("%d pairs of the top 3: %v", len(top.Pairs), err)
+			}
+		})
+	}
+}
+
+func TestAnalyzeSQLite(t *testing.T) {
+	root := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	block := func(n int) string {
+		buf := make([]byte, n)
+		rnd.Read(buf)
+		return string(buf)
+	}
+	shared, other := block(40<<10), block(40<<10)
+	writeFiles(t, root, map[string]string{
+		"a":     block(30<<10) + shared + block(30<<10),
+		"b":     shared + block(50<<10),
+		"c":     shared + other,
+		"d/e":   other + other,
+		"small": "tiny",
+	})
+	params := ChunkParams{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+
+	var analyses []ChunkAnalysis
+	for _, store := range []Store{nil, testStores(t)["sqlite"]} {
+		c := NewChunkScanner(store)
+		c.Params = params
+		c.Stderr = io.Discard
+		if err := c.Scan(context.Background(), root); err != nil {
+			t.Fatal(err)
+		}
+		a, err := c.Analyze(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		analyses = append(analyses, a)
+	}
+	mem, db := analyses[0], analyses[1]
+	if mem.Files != 5 || mem.Savings == 0 || len(mem.Pairs) < 3 {
+		t.Errorf("analysis of %d files, saving %d bytes, of %d pairs", mem.Files, mem.Savings, len(mem.Pairs))
+	}
+	if !reflect.DeepEqual(mem, db) {
+		t.Errorf("analysis in sql %+v, want %+v as in memory", db, mem)
+	}
+}
+
+func TestChunkErrorsRecorded(t *testing.T) {
+	db := testStores(t)["sqlite"].(*SQLiteStore)
+	c := NewChunkScanner(db)
+	c.Stderr = io.Discard
+	if err := c.Scan(context.Background(), filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatal(err)
+	}
+	errs := c.Errors()
+	if len(errs) != 1 || errs[0].Kind != KindVanished {
+		t.Fatalf("errors %v, want the missing root", errs)
+	}
+	if st, err := db.Stats(); err != nil || st.Errors != 1 {
+		t.Errorf("%d errors recorded, want 1: %v", st.Errors, err)
+	}
+}
+
+func TestPruneChunks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"kept": "k", "gone": "g"})
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"kept", "gone"} {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Put(NewEntry(path, "sha256:"+name, info)); err != nil {
+			t.Fatal(err)
+		}
+		e := NewEntry(path, "", info)
+		f := ChunkedFile{Path: path, Params: DefaultChunkParams, Size: e.Size, ModTime: e.ModTime, CTime: e.CTime,
+			Chunks: []Chunk{{Size: 1, Hash: name}}}
+		if err = db.PutChunks(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Remove(filepath.Join(dir, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := db.Prune(time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].Path != filepath.Join(dir, "gone") {
+		t.Errorf("pruned %+v, want gone", pruned)
+	}
+	if _, ok, err := db.GetChunks(filepath.Join(dir, "kept"), DefaultChunkParams); !ok || err != nil {
+		t.Errorf("chunks of the file kept: %v, %v", ok, err)
+	}
+	var files, chunks int
+	if err = db.DB.QueryRow("SELECT COUNT(*) FROM chunked_files").Scan(&files); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DB.QueryRow("SELECT COUNT(*) FROM chunks").Scan(&chunks); err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 || chunks != 1 {
+		t.Errorf("%d chunked files and %d chunks after pruning, want 1 and 1", files, chunks)
+	}
+}
@@ -0,0 +1,188 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Tree is the entries of the files of a directory tree, by their slash
+// separated path relative to its root
+type Tree map[string]Entry
+
+// NewTree returns the entries of entries that are under root
+func NewTree(root string, entries []Entry) Tree {
+	root = filepath.Clean(root)
+	t := Tree{}
+	for _, e := range entries {
+		rel, err := filepath.Rel(root, e.Path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			rel = filepath.Base(e.Path)
+		}
+		t[filepath.ToSlash(rel)] = e
+	}
+	return t
+}
+
+// TreeOf returns the recorded entries of st that are under root
+func TreeOf(st Store, root string) (Tree, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := st.(*SQLiteStore); ok {
+		entries, err := db.ByPath(root)
+		if err != nil {
+			return nil, err
+		}
+		return NewTree(root, entries), nil
+	}
+	dir := strings.TrimSuffix(root, string(os.PathSeparator)) + string(os.PathSeparator)
+	var entries []Entry
+	err = st.Each(func(e Entry) error {
+		if e.Path == root || strings.HasPrefix(e.Path, dir) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(root, entries), nil
+}
+
+// DiffFile is a file of one of the trees of a Diff
+type DiffFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func diffFile(e Entry) DiffFile {
+	return DiffFile{Path: e.Path, Hash: e.Hash, Size: e.Size}
+}
+
+// DiffPair is a file of tree A, and the file of tree B it compares to
+type DiffPair struct {
+	A DiffFile `json:"a"`
+	B DiffFile `json:"b"`
+}
+
+// Diff is the difference of the content of two trees, A and B. Each list is
+// sorted by path.
+type Diff struct {
+	// OnlyA are the files of A whose content is nowhere in B
+	OnlyA []DiffFile `json:"only_a"`
+	// OnlyB are the files of B whose content is nowhere in A
+	OnlyB []DiffFile `json:"only_b"`
+	// Moved are the files at a path of only one of the trees, whose content
+	// is in the other one at another path. The paths of both sides are
+	// paired in order, any left over being paired to the first path of that
+	// content on the other side.
+	Moved []DiffPair `json:"moved"`
+	// Changed are the files at the same path in both trees, with different
+	// content
+	Changed []DiffPair `json:"changed"`
+	// Same is the number of files at the same path in both trees, with the
+	// same content
+	Same int `json:"same"`
+}
+
+// Compare returns the differences of the trees a and b. Their entries must
+// have been hashed with the same Algorithm, as hashes of different algorithms
+// never compare equal.
+func Compare(a, b Tree) Diff {
+	d := Diff{
+		OnlyA:   []DiffFile{},
+		OnlyB:   []DiffFile{},
+		Moved:   []DiffPair{},
+		Changed: []DiffPair{},
+	}
+	// the paths of each tree by hash, and those of them at a path of only
+	// that tree
+	allA, allB := byHash(a, nil), byHash(b, nil)
+	movedA, movedB := byHash(a, b), byHash(b, a)
+
+	for _, rel := range sortedPaths(a) {
+		ea := a[rel]
+		eb, ok := b[rel]
+		switch {
+		case !ok:
+			if len(allB[ea.Hash]) == 0 {
+				d.OnlyA = append(d.OnlyA, diffFile(ea))
+			}
+		case ea.Hash == eb.Hash:
+			d.Same++
+		default:
+			d.Changed = append(d.Changed, DiffPair{A: diffFile(ea), B: diffFile(eb)})
+		}
+	}
+	for _, rel := range sortedPaths(b) {
+		eb := b[rel]
+		if _, ok := a[rel]; !ok && len(allA[eb.Hash]) == 0 {
+			d.OnlyB = append(d.OnlyB, diffFile(eb))
+		}
+	}
+
+	hashes := make([]string, 0, len(movedA)+len(movedB))
+	for hash := range movedA {
+		hashes = append(hashes, hash)
+	}
+	for hash := range movedB {
+		if _, ok := movedA[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	for _, hash := range hashes {
+		pa, pb := movedA[hash], movedB[hash]
+		if len(allA[hash]) == 0 || len(allB[hash]) == 0 {
+			continue
+		}
+		for i := 0; i < len(pa) || i < len(pb); i++ {
+			ra, rb := allA[hash][0], allB[hash][0]
+			if i < len(pa) {
+				ra = pa[i]
+			}
+			if i < len(pb) {
+				rb = pb[i]
+			}
+			d.Moved = append(d.Moved, DiffPair{A: diffFile(a[ra]), B: diffFile(b[rb])})
+		}
+	}
+	sort.Slice(d.Moved, func(i, j int) bool {
+		if d.Moved[i].A.Path != d.Moved[j].A.Path {
+			return d.Moved[i].A.Path < d.Moved[j].A.Path
+		}
+		return d.Moved[i].B.Path < d.Moved[j].B.Path
+	})
+	return d
+}
+
+// byHash returns the sorted paths of t by hash, leaving out those that are
+// in other when it is set
+func byHash(t, other Tree) map[string][]string {
+	paths := map[string][]string{}
+	for _, rel := range sortedPaths(t) {
+		if other != nil {
+			if _, ok := other[rel]; ok {
+				continue
+			}
+		}
+		e := t[rel]
+		paths[e.Hash] = append(paths[e.Hash], rel)
+	}
+	return paths
+}
+
+func sortedPaths(t Tree) []string {
+	paths := make([]string, 0, len(t))
+	for rel := range t {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,107 @@
+package dups
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// diffDB scans the files into a tree of their own, recorded in a database of
+// its own, and returns the tree of the database
+func diffDB(t *testing.T, files map[string]string) Tree {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tree")
+	writeFiles(t, root, files)
+	// a sibling tree of a name starting like the root's is left out
+	writeFiles(t, root+"2", map[string]string{"same.txt": "elsewhere"})
+	db, err := OpenSQLite(filepath.Join(dir, "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTestScanner(db)
+	for _, r := range []string{root, root + "2"} {
+		if _, err := s.Scan(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree, err := TreeOf(db, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestCompare(t *testing.T) {
+	a := diffDB(t, map[string]string{
+		"same.txt":     "same",
+		"sub/same.txt": "same too",
+		"changed.txt":  "before",
+		"only-a.txt":   "only in a",
+		"old/moved":    "moved",
+		"copied":       "copied",
+	})
+	b := diffDB(t, map[string]string{
+		"same.txt":     "same",
+		"sub/same.txt": "same too",
+		"changed.txt":  "after",
+		"only-b.txt":   "only in b",
+		"new/moved":    "moved",
+		"copied":       "copied",
+		"copy/1":       "copied",
+		"copy/2":       "copied",
+	})
+	if len(a) != 6 || len(b) != 8 {
+		t.Fatalf("trees of %d and %d files, want 6 and 8", len(a), len(b))
+	}
+	d := Compare(a, b)
+
+	rels := func(tree Tree, files []DiffFile) []string {
+		var paths []string
+		for _, f := range files {
+			for rel, e := range tree {
+				if e.Path == f.Path {
+					paths = append(paths, rel)
+				}
+			}
+		}
+		return paths
+	}
+	if d.Same != 3 {
+		t.Errorf("%d files the same, want 3", d.Same)
+	}
+	if got := rels(a, d.OnlyA); !reflect.DeepEqual(got, []string{"only-a.txt"}) {
+		t.Errorf("only in a %q", got)
+	}
+	if got := rels(b, d.OnlyB); !reflect.DeepEqual(got, []string{"only-b.txt"}) {
+		t.Errorf("only in b %q", got)
+	}
+	if len(d.Changed) != 1 || d.Changed[0].A.Path != a["changed.txt"].Path || d.Changed[0].B.Path != b["changed.txt"].Path ||
+		d.Changed[0].A.Hash == d.Changed[0].B.Hash {
+		t.Errorf("changed %+v, want changed.txt", d.Changed)
+	}
+
+	var moved [][2]string
+	for _, p := range d.Moved {
+		moved = append(moved, [2]string{rels(a, []DiffFile{p.A})[0], rels(b, []DiffFile{p.B})[0]})
+	}
+	want := [][2]string{
+		// the copies of b are paired to the first path of their content in a
+		{"copied", "copy/1"},
+		{"copied", "copy/2"},
+		{"old/moved", "new/moved"},
+	}
+	if !reflect.DeepEqual(moved, want) {
+		t.Errorf("moved %q, want %q", moved, want)
+	}
+
+	// the other way around
+	d = Compare(b, a)
+	if got := rels(b, d.OnlyA); !reflect.DeepEqual(got, []string{"only-b.txt"}) {
+		t.Errorf("only in a of the reverse %q", got)
+	}
+	if len(d.Moved) != 3 || d.Same != 3 || len(d.Changed) != 1 {
+		t.Errorf("reverse compared %d moved, %d the same, %d changed, want 3, 3 and 1", len(d.Moved), d.Same, len(d.Changed))
+	}
+}
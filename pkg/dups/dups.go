@@ -0,0 +1,111 @@
+// Package dups finds files with duplicate content in a directory tree, keeps a
+// record of their checksums, and optionally replaces the duplicates with links.
+//
+// The pieces are usable on their own: a Scanner walks and hashes a tree, a
+// Store persists what was hashed (in memory as a JSON map, or in sqlite), and
+// a Linker replaces a duplicate with a hard or symbolic link.
+package dups
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Entry is the checksum record of a single file. A Size of -1 means the size
+// is not known.
+type Entry struct {
+	Hash     string    `json:"-"`
+	Path     string    `json:"path"`
+	DeviceID string    `json:"device,omitempty"`
+	Inode    uint64    `json:"inode,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime,omitempty"`
+	CTime    time.Time `json:"ctime,omitempty"`
+}
+
+// entryJSON is the JSON of an Entry, without the times that are not known,
+// which omitempty does not leave out of a time.Time
+type entryJSON struct {
+	entry
+	ModTime *time.Time `json:"mtime,omitempty"`
+	CTime   *time.Time `json:"ctime,omitempty"`
+}
+
+// entry is an Entry without its MarshalJSON
+type entry Entry
+
+func newEntryJSON(e Entry) entryJSON {
+	j := entryJSON{entry: entry(e)}
+	if !e.ModTime.IsZero() {
+		j.ModTime = &e.ModTime
+	}
+	if !e.CTime.IsZero() {
+		j.CTime = &e.CTime
+	}
+	return j
+}
+
+// MarshalJSON writes e, leaving out the times that are not known, like those
+// of records imported from a JSON hash map
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newEntryJSON(e))
+}
+
+// NewEntry fills an Entry for path from its stat info and content hash
+func NewEntry(path, hash string, info os.FileInfo) Entry {
+	e := Entry{
+		Hash:    hash,
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if st, ok := statOf(info); ok {
+		e.DeviceID = formatDevice(st.dev)
+		e.Inode = st.ino
+		e.CTime = st.ctime
+	}
+	return e
+}
+
+// Changed describes how the file now described by cur differs from what e
+// recorded, or returns "" if the content can be assumed unchanged
+func (e Entry) Changed(cur Entry) string {
+	switch {
+	case e.Size != cur.Size:
+		return fmt.Sprintf("size %d -> %d bytes", e.Size, cur.Size)
+	case !e.ModTime.Equal(cur.ModTime):
+		return fmt.Sprintf("mtime %s -> %s", e.ModTime, cur.ModTime)
+	case !e.CTime.Equal(cur.CTime):
+		return fmt.Sprintf("ctime %s -> %s", e.CTime, cur.CTime)
+	case e.Inode != cur.Inode:
+		return fmt.Sprintf("inode %d -> %d", e.Inode, cur.Inode)
+	case e.DeviceID != cur.DeviceID:
+		return fmt.Sprintf("device %s -> %s", e.DeviceID, cur.DeviceID)
+	}
+	return ""
+}
+
+// recorded returns cur as far as e records it. Records from before the ctime
+// and inode were recorded have none, those from before the minor device
+// number was have the major one alone, and the mtimes of those from before
+// nanoseconds were are to the second.
+func (e Entry) recorded(cur Entry) Entry {
+	if e.CTime.IsZero() {
+		cur.CTime = time.Time{}
+	}
+	if e.Inode == 0 {
+		cur.Inode = 0
+	}
+	if e.DeviceID == "" {
+		cur.DeviceID = ""
+	} else if major, _, ok := strings.Cut(cur.DeviceID, ":"); ok && !strings.Contains(e.DeviceID, ":") {
+		cur.DeviceID = major
+	}
+	if e.ModTime.Nanosecond() == 0 {
+		cur.ModTime = cur.ModTime.Truncate(time.Second)
+	}
+	return cur
+}
@@ -0,0 +1,99 @@
+package dups
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The kinds of ScanError besides those named after their operation
+const (
+	KindPermission = "permission"
+	KindVanished   = "vanished"
+)
+
+// ScanError is an error met while scanning, which did not stop the scan
+type ScanError struct {
+	Path string
+	// Op is the operation that failed: "walk", "read", "store" or "link"
+	Op string
+	// Kind is KindPermission or KindVanished for the errors of those causes,
+	// or else the Op
+	Kind string
+	Err  error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("%s %s: %s (%s)", e.Op, e.Path, e.Err, e.Kind)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// newScanError makes the ScanError of op on path, of the kind of err
+func newScanError(op, path string, err error) *ScanError {
+	kind := op
+	if os.IsPermission(err) {
+		kind = KindPermission
+	} else if os.IsNotExist(err) {
+		kind = KindVanished
+	}
+	return &ScanError{Path: path, Op: op, Kind: kind, Err: err}
+}
+
+// ErrorRecorder is implemented by the Stores that keep a log of the errors
+// of scans
+type ErrorRecorder interface {
+	RecordError(e *ScanError) error
+}
+
+// Kinds lists the kinds of ScanError
+func Kinds() []string {
+	return []string{KindPermission, KindVanished, "walk", "read", "store", "link"}
+}
+
+// FailPolicy selects the kinds of ScanError that fail a scan
+type FailPolicy struct {
+	any   bool
+	kinds map[string]bool
+}
+
+// ParseFailPolicy parses "any", "none", or a comma-separated list of the
+// Kinds that fail a scan
+func ParseFailPolicy(s string) (*FailPolicy, error) {
+	switch strings.TrimSpace(s) {
+	case "any":
+		return &FailPolicy{any: true}, nil
+	case "none", "":
+		return &FailPolicy{}, nil
+	}
+	p := &FailPolicy{kinds: map[string]bool{}}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, kind := range Kinds() {
+			if kind == name {
+				p.kinds[kind] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown error kind %q", name)
+		}
+	}
+	return p, nil
+}
+
+// Fails reports whether any of errs is of a kind of p
+func (p *FailPolicy) Fails(errs []*ScanError) bool {
+	for _, e := range errs {
+		if p.any || p.kinds[e.Kind] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package dups
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		op   string
+		err  error
+		kind string
+	}{
+		{"read", &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}, KindPermission},
+		{"walk", &os.PathError{Op: "lstat", Path: "/x", Err: os.ErrNotExist}, KindVanished},
+		{"read", errors.New("short read"), "read"},
+		{"store", errors.New("database is locked"), "store"},
+		{"link", &os.LinkError{Op: "link", Old: "/a", New: "/b", Err: os.ErrPermission}, KindPermission},
+	} {
+		e := newScanError(tc.op, "/x", tc.err)
+		if e.Kind != tc.kind || e.Op != tc.op {
+			t.Errorf("%s of %v: op %s, kind %s, want %s", tc.op, tc.err, e.Op, e.Kind, tc.kind)
+		}
+		if !errors.Is(e, tc.err) {
+			t.Errorf("%v does not unwrap to %v", e, tc.err)
+		}
+	}
+}
+
+func TestFailPolicy(t *testing.T) {
+	var (
+		vanished = newScanError("read", "/a", os.ErrNotExist)
+		read     = newScanError("read", "/b", errors.New("I/O error"))
+	)
+	for _, tc := range []struct {
+		policy string
+		errs   []*ScanError
+		fails  bool
+	}{
+		{"any", nil, false},
+		{"any", []*ScanError{vanished}, true},
+		{"none", []*ScanError{vanished, read}, false},
+		{"", []*ScanError{read}, false},
+		{"vanished", []*ScanError{vanished}, true},
+		{"vanished", []*ScanError{read}, false},
+		{"permission, Read", []*ScanError{vanished, read}, true},
+		{"walk,store,link", []*ScanError{vanished, read}, false},
+	} {
+		p, err := ParseFailPolicy(tc.policy)
+		if err != nil {
+			t.Errorf("ParseFailPolicy(%q): %v", tc.policy, err)
+			continue
+		}
+		if fails := p.Fails(tc.errs); fails != tc.fails {
+			t.Errorf("%q failing on %v = %v, want %v", tc.policy, tc.errs, fails, tc.fails)
+		}
+	}
+	if _, err := ParseFailPolicy("read,vanish"); err == nil {
+		t.Error("ParseFailPolicy took an unknown kind")
+	}
+}
+
+// failingStore fails to record any file, and keeps the errors of the scan
+type failingStore struct {
+	*MapStore
+	errs []*ScanError
+}
+
+func (fs *failingStore) Put(e Entry) error {
+	return errors.New("no space left")
+}
+
+func (fs *failingStore) RecordError(e *ScanError) error {
+	fs.errs = append(fs.errs, e)
+	return nil
+}
+
+func TestScanErrorsRecorded(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "x", "b": "y"})
+	store := &failingStore{MapStore: NewMapStore()}
+	s := newTestScanner(store)
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	if errs := s.Errors(); len(errs) != 2 || len(store.errs) != 2 {
+		t.Fatalf("%d errors, %d recorded, want 2", len(errs), len(store.errs))
+	}
+	for _, e := range store.errs {
+		if e.Op != "store" || e.Kind != "store" {
+			t.Errorf("recorded %v, want a store error", e)
+		}
+	}
+	if st := s.Stats(); st.Errors["store"] != 2 {
+		t.Errorf("counted errors %v, want 2 of store", st.Errors)
+	}
+}
+
+func TestSQLiteRecordError(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTestScanner(db)
+	s.fail("read", "/a", &os.PathError{Op: "open", Path: "/a", Err: os.ErrPermission})
+	s.fail("walk", "/b", errors.New("too many open files"))
+
+	rows, err := db.DB.Query("SELECT file_path, op, kind FROM scan_errors ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][3]string
+	for rows.Next() {
+		var r [3]string
+		if err := rows.Scan(&r[0], &r[1], &r[2]); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	want := [][3]string{{"/a", "read", KindPermission}, {"/b", "walk", "walk"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("scan_errors %q, want %q", got, want)
+	}
+	if st, err := db.Stats(); err != nil || st.Errors != 2 {
+		t.Errorf("Stats counted %d errors, want 2: %v", st.Errors, err)
+	}
+}
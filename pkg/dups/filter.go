@@ -0,0 +1,290 @@
+package dups
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultIgnoreFile is the name of the files listing, like a .gitignore, the
+// paths of their directory tree that are not scanned
+const DefaultIgnoreFile = ".dupsignore"
+
+// vcsDirs are the metadata directories of version control systems
+var vcsDirs = map[string]bool{
+	".git":   true,
+	".hg":    true,
+	".svn":   true,
+	".bzr":   true,
+	"CVS":    true,
+	"_darcs": true,
+}
+
+// Filter selects the files that a Scanner hashes. Patterns are matched
+// against the path relative to the scanned root, using forward slashes.
+type Filter struct {
+	// Include, if not empty, restricts scanning to the files matching one of
+	// these patterns
+	Include []Pattern
+	// Exclude skips the files, and directories, matching any of these
+	// patterns
+	Exclude []Pattern
+	// MinSize and MaxSize, when not 0, skip the files smaller or larger
+	MinSize int64
+	MaxSize int64
+	// SkipHidden skips the files and directories whose name starts with "."
+	SkipHidden bool
+	// SkipVCS skips the metadata directories of version control systems,
+	// like .git
+	SkipVCS bool
+	// IgnoreFile, if set, is the name of the files read in each directory
+	// for gitignore-style patterns of the paths to skip under it
+	IgnoreFile string
+}
+
+// Pattern matches paths with a glob, or a regular expression. Globs without a
+// "/" match the name of a file at any depth, and "**" matches any number of
+// directories.
+type Pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// ParsePattern parses s as a glob, or as a regular expression when prefixed
+// with "re:"
+func ParsePattern(s string) (Pattern, error) {
+	if expr := strings.TrimPrefix(s, "re:"); expr != s {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return Pattern{}, err
+		}
+		return Pattern{re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return Pattern{}, fmt.Errorf("bad pattern %q: %v", s, err)
+	}
+	return Pattern{glob: s}, nil
+}
+
+func (p Pattern) String() string {
+	if p.re != nil {
+		return "re:" + p.re.String()
+	}
+	return p.glob
+}
+
+// Match reports whether the slash separated relative path rel matches p
+func (p Pattern) Match(rel string) bool {
+	if p.re != nil {
+		return p.re.MatchString(rel)
+	}
+	return matchPath(p.glob, rel)
+}
+
+// matchPath matches rel against glob, or its name when glob has no "/"
+func matchPath(glob, rel string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(glob, "/"), "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches the directories of a path, with "**" matching any
+// number of them
+func matchSegments(glob, names []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(glob[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], names[0]); !ok {
+			return false
+		}
+		glob, names = glob[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// ParseSize parses a number of bytes, with an optional K, M, G or T suffix
+// of the powers of 1024
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if i := len(num) - 1; i >= 0 && strings.IndexByte("KMGT", num[i]) >= 0 {
+		mult = 1 << (10 * uint(strings.IndexByte("KMGT", num[i])+1))
+		num = num[:i]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// ignoreRule is a pattern line of an ignore file
+type ignoreRule struct {
+	glob    string
+	negate  bool
+	dirOnly bool
+}
+
+// readIgnoreFile parses the gitignore-style patterns of the file at name
+func readIgnoreFile(name string) ([]ignoreRule, error) {
+	fh, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "/") && !strings.HasPrefix(line, "/") {
+			// patterns with a "/" are relative to the directory of the file
+			line = "/" + line
+		}
+		r.glob = line
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// filterWalk is the state of a Filter during the walk of root: the rules of
+// the ignore files read so far, by directory
+type filterWalk struct {
+	f     *Filter
+	root  string
+	rules map[string][]ignoreRule
+}
+
+// walk returns the state of f for a walk of root, or nil when f is nil
+func (f *Filter) walk(root string) *filterWalk {
+	if f == nil {
+		return nil
+	}
+	return &filterWalk{f: f, root: filepath.Clean(root), rules: map[string][]ignoreRule{}}
+}
+
+// skip reports whether the file or directory at p is filtered out. It must be
+// called for each directory before the files in it.
+func (w *filterWalk) skip(p string, info os.FileInfo) bool {
+	if w == nil {
+		return false
+	}
+	f := w.f
+	isRoot := filepath.Clean(p) == w.root
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil {
+		rel = p
+	}
+	rel = filepath.ToSlash(rel)
+	if !isRoot {
+		name := info.Name()
+		if f.SkipHidden && strings.HasPrefix(name, ".") {
+			return true
+		}
+		if f.SkipVCS && info.IsDir() && vcsDirs[name] {
+			return true
+		}
+		for _, pat := range f.Exclude {
+			if pat.Match(rel) {
+				return true
+			}
+		}
+		if w.ignored(p, info.IsDir()) {
+			return true
+		}
+	}
+	if info.IsDir() {
+		if f.IgnoreFile != "" {
+			if rules, err := readIgnoreFile(filepath.Join(p, f.IgnoreFile)); err == nil && len(rules) > 0 {
+				w.rules[filepath.Clean(p)] = rules
+			}
+		}
+		return false
+	}
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	if f.MinSize > 0 && info.Size() < f.MinSize {
+		return true
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return true
+	}
+	if len(f.Include) > 0 && !isRoot {
+		for _, pat := range f.Include {
+			if pat.Match(rel) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ignored applies the rules of the ignore files of the directories above p,
+// the deeper ones and the later lines taking precedence
+func (w *filterWalk) ignored(p string, isDir bool) bool {
+	if len(w.rules) == 0 {
+		return false
+	}
+	var dirs []string
+	for dir := filepath.Dir(filepath.Clean(p)); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == w.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules := w.rules[dirs[i]]
+		if len(rules) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(dirs[i], p)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, r := range rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if matchPath(r.glob, rel) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
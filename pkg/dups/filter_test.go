@@ -0,0 +1,127 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		// without a "/", the name is matched at any depth
+		{"*.log", "a.log", true},
+		{"*.log", "x/y/a.log", true},
+		{"*.log", "a.log/b", false},
+		{"a?c", "dir/abc", true},
+		// with one, the whole path from the root
+		{"x/*.log", "x/a.log", true},
+		{"x/*.log", "y/x/a.log", false},
+		{"/x/*.log", "x/a.log", true},
+		{"x/*", "x/y/a.log", false},
+		{"x/**/a.log", "x/a.log", true},
+		{"x/**/a.log", "x/y/z/a.log", true},
+		{"**/a.log", "y/a.log", true},
+		{"x/**", "x/y/a.log", true},
+		{"x/**", "y/a.log", false},
+		// regular expressions match anywhere in the path
+		{`re:\.log$`, "x/a.log", true},
+		{`re:\.log$`, "x/a.logs", false},
+		{`re:^x/`, "x/a", true},
+		{`re:^x/`, "y/x/a", false},
+	} {
+		p, err := ParsePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("ParsePattern(%q): %v", tc.pattern, err)
+			continue
+		}
+		if got := p.Match(tc.rel); got != tc.want {
+			t.Errorf("%q matching %q = %v, want %v", tc.pattern, tc.rel, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"[", "re:("} {
+		if _, err := ParsePattern(bad); err == nil {
+			t.Errorf("ParsePattern(%q) took a bad pattern", bad)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), DefaultIgnoreFile)
+	content := strings.Join([]string{
+		"# a comment",
+		"",
+		"*.tmp  ",
+		"!keep.tmp",
+		"build/",
+		"/top",
+		"a/b",
+		`\!bang`,
+		`\#hash`,
+		"!",
+	}, "\n")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readIgnoreFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ignoreRule{
+		{glob: "*.tmp"},
+		{glob: "keep.tmp", negate: true},
+		{glob: "build", dirOnly: true},
+		{glob: "/top"},
+		{glob: "/a/b"},
+		{glob: "!bang"},
+		{glob: "#hash"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules %+v, want %+v", rules, want)
+	}
+}
+
+func TestScanIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		DefaultIgnoreFile:          "*.tmp\n!keep.tmp\nbuild/\n/local\n",
+		"a.tmp":                    "ignored",
+		"keep.tmp":                 "negated",
+		"build/x":                  "in an ignored directory",
+		"other/build":              "a file, not a directory",
+		"local":                    "anchored to the root",
+		"x.txt":                    "kept",
+		"sub/" + DefaultIgnoreFile: "!*.tmp\n/local\ndata/*.bin\n",
+		"sub/b.tmp":                "negated by the deeper file",
+		"sub/local":                "anchored to sub",
+		"sub/deep/local":           "not at the top of sub",
+		"sub/data/c.bin":           "anchored to sub",
+		"sub/deep/data/c.bin":      "not under sub/data",
+	})
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Filter = &Filter{IgnoreFile: DefaultIgnoreFile}
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	store.Each(func(e Entry) error {
+		rel, _ := filepath.Rel(root, e.Path)
+		if filepath.Base(rel) != DefaultIgnoreFile {
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(got)
+	want := []string{"keep.tmp", "other/build", "sub/b.tmp", "sub/deep/data/c.bin", "sub/deep/local", "x.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %q, want %q", got, want)
+	}
+}
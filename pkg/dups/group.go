@@ -0,0 +1,144 @@
+package dups
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// Group is the set of files that share a content hash
+type Group struct {
+	Hash  string
+	Files []Entry
+}
+
+// Size is the size of a single copy of the content
+func (g Group) Size() int64 {
+	for _, e := range g.Files {
+		if e.Size >= 0 {
+			return e.Size
+		}
+	}
+	return 0
+}
+
+// Copies is the number of independent copies of the content. Files that are
+// already hardlinked to each other count once.
+func (g Group) Copies() int {
+	type fileID struct {
+		dev   string
+		inode uint64
+	}
+	seen := map[fileID]bool{}
+	copies := 0
+	for _, e := range g.Files {
+		if IsArchiveMember(e.Path) {
+			// members of archives are not copies that can be reclaimed
+			continue
+		}
+		if e.Inode != 0 {
+			id := fileID{e.DeviceID, e.Inode}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		copies++
+	}
+	return copies
+}
+
+// Reclaimable is the number of bytes freed by keeping a single copy
+func (g Group) Reclaimable() int64 {
+	if g.Copies() < 2 {
+		return 0
+	}
+	return int64(g.Copies()-1) * g.Size()
+}
+
+// Groups collects the entries of st by hash, in the order the hashes were
+// first recorded
+func Groups(st Store) ([]Group, error) {
+	var groups []Group
+	index := map[string]int{}
+	err := st.Each(func(e Entry) error {
+		i, ok := index[e.Hash]
+		if !ok {
+			i = len(groups)
+			index[e.Hash] = i
+			groups = append(groups, Group{Hash: e.Hash})
+		}
+		groups[i].Files = append(groups[i].Files, e)
+		return nil
+	})
+	return groups, err
+}
+
+// DuplicateGroups returns the groups of st with more than one independent
+// copy, sorted by the most reclaimable bytes first. Groups whose files are
+// all hardlinks of each other are left out, as there is nothing to reclaim.
+func DuplicateGroups(st Store) ([]Group, error) {
+	groups, err := Groups(st)
+	if err != nil {
+		return nil, err
+	}
+	var dups []Group
+	for _, g := range groups {
+		if g.Copies() > 1 {
+			dups = append(dups, g)
+		}
+	}
+	sort.SliceStable(dups, func(i, j int) bool {
+		return dups[i].Reclaimable() > dups[j].Reclaimable()
+	})
+	return dups, nil
+}
+
+// ReadGroups reads a JSON object of hash to the list of files with that
+// content. The older format of hash to a single path is accepted too, with
+// the size of those files unknown, as are untagged hashes of the
+// DefaultAlgorithm.
+func ReadGroups(r io.Reader) ([]Group, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]json.RawMessage{}
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+
+	groups := make([]Group, 0, len(m))
+	for hash, raw := range m {
+		hash = NormalizeDigest(hash)
+		g := Group{Hash: hash}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+			e := Entry{Size: -1}
+			if err = json.Unmarshal(raw, &e.Path); err != nil {
+				return nil, err
+			}
+			g.Files = []Entry{e}
+		} else if err = json.Unmarshal(raw, &g.Files); err != nil {
+			return nil, err
+		}
+		for i := range g.Files {
+			g.Files[i].Hash = hash
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Hash < groups[j].Hash })
+	return groups, nil
+}
+
+// WriteGroups writes groups as a JSON object of hash to the list of files
+// with that content
+func WriteGroups(w io.Writer, groups []Group) error {
+	m := make(map[string][]Entry, len(groups))
+	for _, g := range groups {
+		m[g.Hash] = append(m[g.Hash], g.Files...)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
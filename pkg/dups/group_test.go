@@ -0,0 +1,110 @@
+package dups
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteGroupsUnknownTimes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	groups := []Group{{Hash: "sha256:aa", Files: []Entry{
+		{Hash: "sha256:aa", Path: "/imported", Size: -1},
+		{Hash: "sha256:aa", Path: "/scanned", Size: 3, ModTime: mtime},
+	}}}
+	var buf bytes.Buffer
+	if err := WriteGroups(&buf, groups); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "0001-01-01") || strings.Contains(out, "ctime") ||
+		strings.Count(out, `"mtime"`) != 1 {
+		t.Errorf("times not known are written:\n%s", out)
+	}
+
+	read, err := ReadGroups(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || len(read[0].Files) != 2 {
+		t.Fatalf("read back %+v", read)
+	}
+	for _, e := range read[0].Files {
+		if e.Path == "/scanned" && !e.ModTime.Equal(mtime) {
+			t.Errorf("read back mtime %s, want %s", e.ModTime, mtime)
+		}
+		if e.Path == "/imported" && !e.ModTime.IsZero() {
+			t.Errorf("read back mtime %s, want none", e.ModTime)
+		}
+	}
+}
+
+func TestDuplicateGroupsLinked(t *testing.T) {
+	ms := NewMapStore()
+	for _, e := range []Entry{
+		// hardlinks of a single copy
+		{Hash: "sha256:aa", Path: "/a", DeviceID: "8:1", Inode: 1, Size: 10},
+		{Hash: "sha256:aa", Path: "/b", DeviceID: "8:1", Inode: 1, Size: 10},
+		// two copies, one of them linked twice
+		{Hash: "sha256:bb", Path: "/c", DeviceID: "8:1", Inode: 2, Size: 20},
+		{Hash: "sha256:bb", Path: "/d", DeviceID: "8:1", Inode: 2, Size: 20},
+		{Hash: "sha256:bb", Path: "/e", DeviceID: "8:1", Inode: 3, Size: 20},
+	} {
+		ms.Put(e)
+	}
+	groups, err := DuplicateGroups(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Hash != "sha256:bb" {
+		t.Fatalf("groups %+v, want only sha256:bb", groups)
+	}
+	if g := groups[0]; g.Copies() != 2 || g.Reclaimable() != 20 {
+		t.Errorf("%d copies, %d reclaimable, want 2 and 20", g.Copies(), g.Reclaimable())
+	}
+}
+
+func TestGroupRecordsOrder(t *testing.T) {
+	ms := NewMapStore()
+	for _, e := range []Entry{
+		{Hash: "sha256:aa", Path: "/a1", Size: 1},
+		{Hash: "sha256:aa", Path: "/a2", Size: 1},
+		{Hash: "sha256:bb", Path: "/b1", Size: 30},
+		{Hash: "sha256:bb", Path: "/b2", Size: 30},
+		{Hash: "sha256:cc", Path: "/c1", Size: 10},
+		{Hash: "sha256:cc", Path: "/c2", Size: 10},
+		{Hash: "sha256:cc", Path: "/c3", Size: 10},
+	} {
+		ms.Put(e)
+	}
+	groups, err := DuplicateGroups(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []GroupRecord
+	for _, g := range groups {
+		records = append(records, NewGroupRecord(g))
+	}
+	buf, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []GroupRecord
+	if err = json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		hash        string
+		copies      int
+		reclaimable int64
+	}{{"sha256:bb", 2, 30}, {"sha256:cc", 3, 20}, {"sha256:aa", 2, 1}}
+	if len(got) != len(want) {
+		t.Fatalf("records %s", buf)
+	}
+	for i, w := range want {
+		if got[i].Hash != w.hash || got[i].Copies != w.copies || got[i].Reclaimable != w.reclaimable {
+			t.Errorf("record %d %+v, want %+v", i, got[i], w)
+		}
+	}
+}
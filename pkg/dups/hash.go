@@ -0,0 +1,99 @@
+package dups
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Algorithm names the hash function used for the content of files. Hashes are
+// kept as a digest string of "<algorithm>:<hex>", so that hashes of different
+// algorithms never compare equal.
+type Algorithm string
+
+// The supported algorithms. XXHash is fast but not collision resistant, and is
+// best suited to prefiltering.
+const (
+	SHA1    Algorithm = "sha1"
+	SHA256  Algorithm = "sha256"
+	SHA512  Algorithm = "sha512"
+	BLAKE2b Algorithm = "blake2b"
+	XXHash  Algorithm = "xxhash"
+)
+
+// DefaultAlgorithm is used when none is set, and is assumed for the untagged
+// hashes of older databases and JSON maps
+const DefaultAlgorithm = SHA1
+
+// Algorithms lists the supported algorithms
+func Algorithms() []Algorithm {
+	return []Algorithm{SHA1, SHA256, SHA512, BLAKE2b, XXHash}
+}
+
+// ParseAlgorithm validates the algorithm name s
+func ParseAlgorithm(s string) (Algorithm, error) {
+	for _, a := range Algorithms() {
+		if string(a) == strings.ToLower(s) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", s)
+}
+
+// CollisionResistant reports whether files of the same hash of a can be
+// taken to have the same content, for one to be replaced by a link to the
+// other without comparing them
+func (a Algorithm) CollisionResistant() bool {
+	return a != XXHash
+}
+
+// New returns a new hash.Hash of the algorithm
+func (a Algorithm) New() (hash.Hash, error) {
+	switch a {
+	case SHA1, "":
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	case BLAKE2b:
+		return blake2b.New256(nil)
+	case XXHash:
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", string(a))
+}
+
+// Digest returns the digest string of sum
+func (a Algorithm) Digest(sum []byte) string {
+	if a == "" {
+		a = DefaultAlgorithm
+	}
+	return fmt.Sprintf("%s:%x", a, sum)
+}
+
+// SplitDigest splits a digest string into its algorithm and hex sum. An
+// untagged hex sum is of the DefaultAlgorithm.
+func SplitDigest(digest string) (Algorithm, string) {
+	if i := strings.IndexByte(digest, ':'); i >= 0 {
+		return Algorithm(digest[:i]), digest[i+1:]
+	}
+	return DefaultAlgorithm, digest
+}
+
+// NormalizeDigest tags an untagged hex sum with the DefaultAlgorithm
+func NormalizeDigest(digest string) string {
+	a, sum := SplitDigest(digest)
+	return joinDigest(string(a), sum)
+}
+
+// joinDigest makes the digest string of an algorithm name and hex sum
+func joinDigest(alg, hex string) string {
+	return alg + ":" + hex
+}
@@ -0,0 +1,387 @@
+package dups
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg" // decoders of the images hashed
+	_ "image/png"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageAlgorithm names a perceptual hash of the content of images, which
+// changes little when an image is re-encoded or resized
+type ImageAlgorithm string
+
+// The supported perceptual hashes, all of 64 bits
+const (
+	// AHash compares each pixel of an 8x8 grayscale thumbnail to their mean
+	AHash ImageAlgorithm = "ahash"
+	// DHash compares each pixel of a 9x8 grayscale thumbnail to the next
+	DHash ImageAlgorithm = "dhash"
+	// PHash compares the low frequencies of the discrete cosine transform
+	// of a 32x32 grayscale thumbnail to their median
+	PHash ImageAlgorithm = "phash"
+)
+
+// ImageAlgorithms lists the supported perceptual hashes
+func ImageAlgorithms() []ImageAlgorithm {
+	return []ImageAlgorithm{AHash, DHash, PHash}
+}
+
+// ParseImageAlgorithm validates the perceptual hash name s
+func ParseImageAlgorithm(s string) (ImageAlgorithm, error) {
+	for _, a := range ImageAlgorithms() {
+		if string(a) == strings.ToLower(s) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown image hash algorithm %q", s)
+}
+
+// PerceptualHash is a 64 bit perceptual hash, written as 16 hex digits
+type PerceptualHash uint64
+
+func (h PerceptualHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// MarshalText writes h in hex, as JSON numbers of 64 bits lose precision
+func (h PerceptualHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText reads the hex of h
+func (h *PerceptualHash) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil {
+		return fmt.Errorf("bad perceptual hash %q", text)
+	}
+	*h = PerceptualHash(v)
+	return nil
+}
+
+// imageExts are the extensions of the files decoded for a perceptual hash
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// isImage reports whether path is named like a JPEG or PNG image
+func isImage(path string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// ImageEntry is the perceptual hash record of an image
+type ImageEntry struct {
+	Path      string         `json:"path"`
+	Algorithm ImageAlgorithm `json:"algorithm"`
+	Hash      PerceptualHash `json:"hash"`
+	Size      int64          `json:"size"`
+	ModTime   time.Time      `json:"mtime,omitempty"`
+	CTime     time.Time      `json:"ctime,omitempty"`
+	// Digest is the content hash of the file, when known, to tell apart
+	// the byte-exact duplicates
+	Digest string `json:"digest,omitempty"`
+}
+
+// newImageEntry fills an ImageEntry for path from its stat info
+func newImageEntry(path string, alg ImageAlgorithm, hash PerceptualHash, info os.FileInfo) ImageEntry {
+	e := NewEntry(path, "", info)
+	return ImageEntry{Path: path, Algorithm: alg, Hash: hash, Size: e.Size, ModTime: e.ModTime, CTime: e.CTime}
+}
+
+// ImageStore is implemented by the Stores that keep the perceptual hashes of
+// images too
+type ImageStore interface {
+	// GetImage returns the record of the hash alg of path. ok is false when
+	// there is none.
+	GetImage(path string, alg ImageAlgorithm) (e ImageEntry, ok bool, err error)
+	// PutImage records e, replacing any existing record for its path and
+	// algorithm
+	PutImage(e ImageEntry) error
+}
+
+// MaxImagePixels is the most pixels of the images hashed, as decoding takes
+// several bytes of memory per pixel
+const MaxImagePixels = 100 << 20
+
+// ImageHashFile decodes the JPEG or PNG image at path, and returns its
+// perceptual hash of alg. Images of more than MaxImagePixels are not decoded.
+func ImageHashFile(path string, alg ImageAlgorithm) (PerceptualHash, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	config, _, err := image.DecodeConfig(fh)
+	if err != nil {
+		return 0, err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > MaxImagePixels {
+		return 0, fmt.Errorf("image of %dx%d pixels, more than %d", config.Width, config.Height, MaxImagePixels)
+	}
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	img, _, err := image.Decode(fh)
+	if err != nil {
+		return 0, err
+	}
+	return ImageHash(img, alg)
+}
+
+// ImageHash returns the perceptual hash of alg of img
+func ImageHash(img image.Image, alg ImageAlgorithm) (PerceptualHash, error) {
+	var hash PerceptualHash
+	switch alg {
+	case AHash:
+		pixels := grayThumbnail(img, 8, 8)
+		mean := 0.0
+		for _, p := range pixels {
+			mean += p
+		}
+		mean /= float64(len(pixels))
+		for i, p := range pixels {
+			if p > mean {
+				hash |= 1 << uint(i)
+			}
+		}
+	case DHash:
+		pixels := grayThumbnail(img, 9, 8)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				if pixels[y*9+x+1] > pixels[y*9+x] {
+					hash |= 1 << uint(y*8+x)
+				}
+			}
+		}
+	case PHash:
+		const n = 32
+		coeffs := dct2(grayThumbnail(img, n, n), n)
+		low := make([]float64, 0, 64)
+		for y := 0; y < 8; y++ {
+			low = append(low, coeffs[y*n:y*n+8]...)
+		}
+		// the DC term is left out of the median, being the mean brightness
+		sorted := append([]float64(nil), low[1:]...)
+		sort.Float64s(sorted)
+		median := sorted[len(sorted)/2]
+		for i, c := range low {
+			if c > median {
+				hash |= 1 << uint(i)
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unknown image hash algorithm %q", alg)
+	}
+	return hash, nil
+}
+
+// grayThumbnail scales img down to w by h pixels of luminance, each the mean
+// of the pixels of img it covers
+func grayThumbnail(img image.Image, w, h int) []float64 {
+	b := img.Bounds()
+	sums := make([]float64, w*h)
+	counts := make([]int, w*h)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		ty := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			tx := (x - b.Min.X) * w / b.Dx()
+			sums[ty*w+tx] += luminance(img, x, y)
+			counts[ty*w+tx]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	if b.Dx() < w || b.Dy() < h {
+		// images smaller than the thumbnail leave cells uncovered, which
+		// take the nearest pixel instead
+		for ty := 0; ty < h; ty++ {
+			for tx := 0; tx < w; tx++ {
+				if counts[ty*w+tx] == 0 {
+					x, y := b.Min.X+tx*b.Dx()/w, b.Min.Y+ty*b.Dy()/h
+					sums[ty*w+tx] = luminance(img, x, y)
+				}
+			}
+		}
+	}
+	return sums
+}
+
+// luminance is the brightness of the pixel of img at x, y. The luma of
+// decoded JPEGs is read as is, which is much faster than converting them to
+// RGB.
+func luminance(img image.Image, x, y int) float64 {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return float64(img.Y[img.YOffset(x, y)]) * 0x101
+	case *image.Gray:
+		return float64(img.Pix[img.PixOffset(x, y)]) * 0x101
+	}
+	r, g, b, _ := img.At(x, y).RGBA()
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
+
+// dct2 is the 2D discrete cosine transform (type II) of the n by n values
+func dct2(values []float64, n int) []float64 {
+	cos := make([]float64, n*n)
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			cos[k*n+i] = math.Cos(math.Pi / float64(n) * (float64(i) + 0.5) * float64(k))
+		}
+	}
+	rows := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for k := 0; k < n; k++ {
+			sum := 0.0
+			for x := 0; x < n; x++ {
+				sum += values[y*n+x] * cos[k*n+x]
+			}
+			rows[y*n+k] = sum
+		}
+	}
+	out := make([]float64, n*n)
+	for x := 0; x < n; x++ {
+		for k := 0; k < n; k++ {
+			sum := 0.0
+			for y := 0; y < n; y++ {
+				sum += rows[y*n+x] * cos[k*n+y]
+			}
+			out[k*n+x] = sum
+		}
+	}
+	return out
+}
+
+// DefaultSimilarDistance is the number of bits by which the perceptual hashes
+// of images may differ for them to be deemed similar, when none is set
+const DefaultSimilarDistance = 10
+
+// Hamming is the number of bits that differ between two perceptual hashes
+func Hamming(a, b PerceptualHash) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// SimilarGroup is a set of images whose perceptual hashes are each within a
+// distance of another of the set
+type SimilarGroup struct {
+	Files []ImageEntry `json:"files"`
+	// Distances are those of each file to the first one
+	Distances []int `json:"distances"`
+}
+
+// GroupSimilar groups the images whose perceptual hashes are within
+// maxDistance bits of each other. Groups whose files all have the same
+// content are left out, being byte-exact duplicates. Files are sorted by
+// path, and groups by their first file.
+func GroupSimilar(images []ImageEntry, maxDistance int) []SimilarGroup {
+	// union-find of the images by index
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, bucket := range similarCandidates(images, maxDistance) {
+		for x, i := range bucket {
+			for _, j := range bucket[x+1:] {
+				if find(i) != find(j) && Hamming(images[i].Hash, images[j].Hash) <= maxDistance {
+					parent[find(j)] = find(i)
+				}
+			}
+		}
+	}
+
+	sets := map[int][]ImageEntry{}
+	for i, e := range images {
+		root := find(i)
+		sets[root] = append(sets[root], e)
+	}
+	groups := []SimilarGroup{}
+	for _, files := range sets {
+		if len(files) < 2 || sameDigest(files) {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+		g := SimilarGroup{Files: files}
+		for _, e := range files {
+			g.Distances = append(g.Distances, Hamming(files[0].Hash, e.Hash))
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0].Path < groups[j].Files[0].Path })
+	return groups
+}
+
+// similarCandidates returns buckets of the indexes of images, such that any
+// two images of the same algorithm within maxDistance bits are in one of the
+// buckets together. The hashes are split into maxDistance+1 bands, of which
+// two such hashes must have one the same, by the pigeonhole principle, so
+// that only the images sharing a band are compared rather than every pair.
+func similarCandidates(images []ImageEntry, maxDistance int) [][]int {
+	if maxDistance < 0 {
+		return nil
+	}
+	bands := maxDistance + 1
+	if bands > 64 {
+		// any two hashes are within the distance
+		byAlgorithm := map[ImageAlgorithm][]int{}
+		for i, e := range images {
+			byAlgorithm[e.Algorithm] = append(byAlgorithm[e.Algorithm], i)
+		}
+		var buckets [][]int
+		for _, bucket := range byAlgorithm {
+			buckets = append(buckets, bucket)
+		}
+		return buckets
+	}
+
+	type key struct {
+		alg   ImageAlgorithm
+		band  int
+		value uint64
+	}
+	byBand := map[key][]int{}
+	for i, e := range images {
+		for band := 0; band < bands; band++ {
+			lo, hi := band*64/bands, (band+1)*64/bands
+			value := uint64(e.Hash) >> lo & (1<<(hi-lo) - 1)
+			k := key{e.Algorithm, band, value}
+			byBand[k] = append(byBand[k], i)
+		}
+	}
+	buckets := make([][]int, 0, len(byBand))
+	for _, bucket := range byBand {
+		if len(bucket) > 1 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// sameDigest reports whether files all have the same known content hash
+func sameDigest(files []ImageEntry) bool {
+	for _, e := range files {
+		if e.Digest == "" || e.Digest != files[0].Digest {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package dups
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// noiseImage returns an image of random gray pixels of seed
+func noiseImage(w, h int, seed int64) *image.Gray {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rnd.Intn(256))
+	}
+	return img
+}
+
+func TestImageHashPHashMedian(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		hash, err := ImageHash(noiseImage(64, 64, seed), PHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// of the 63 coefficients but the DC term, those above their
+		// median are 31
+		if n := bits.OnesCount64(uint64(hash) &^ 1); n != 31 {
+			t.Errorf("seed %d: %d coefficients above the median, want 31", seed, n)
+		}
+	}
+}
+
+func TestImageHashFile(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	img := noiseImage(40, 30, 1)
+	img.Set(0, 0, color.Gray{Y: 255})
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "small.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ImageHash(img, DHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ImageHashFile(path, DHash); err != nil || got != want {
+		t.Errorf("ImageHashFile %s, %v, want %s", got, err, want)
+	}
+
+	// a PNG header of more pixels than MaxImagePixels is not decoded any
+	// further
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 1<<15)
+	binary.BigEndian.PutUint32(ihdr[4:], 1<<15)
+	ihdr[8], ihdr[9] = 8, 0 // 8 bit grayscale
+	huge := []byte("\x89PNG\r\n\x1a\n")
+	huge = binary.BigEndian.AppendUint32(huge, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	huge = append(huge, chunk...)
+	huge = binary.BigEndian.AppendUint32(huge, crc32.ChecksumIEEE(chunk))
+	path = filepath.Join(dir, "huge.png")
+	if err := os.WriteFile(path, huge, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImageHashFile(path, DHash); err == nil || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("ImageHashFile of a huge image: %v, want an error of its pixels", err)
+	}
+}
+
+// bruteSimilar is GroupSimilar comparing every pair of images
+func bruteSimilar(images []ImageEntry, maxDistance int) []SimilarGroup {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if images[i].Algorithm == images[j].Algorithm && Hamming(images[i].Hash, images[j].Hash) <= maxDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	sets := map[int][]ImageEntry{}
+	for i, e := range images {
+		root := find(i)
+		sets[root] = append(sets[root], e)
+	}
+	groups := []SimilarGroup{}
+	for _, files := range sets {
+		if len(files) < 2 || sameDigest(files) {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+		g := SimilarGroup{Files: files}
+		for _, e := range files {
+			g.Distances = append(g.Distances, Hamming(files[0].Hash, e.Hash))
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0].Path < groups[j].Files[0].Path })
+	return groups
+}
+
+func TestGroupSimilar(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var images []ImageEntry
+	centers := make([]uint64, 30)
+	for i := range centers {
+		centers[i] = rnd.Uint64()
+	}
+	for i := 0; i < 400; i++ {
+		h := centers[rnd.Intn(len(centers))]
+		for flips := rnd.Intn(12); flips > 0; flips-- {
+			h ^= 1 << uint(rnd.Intn(64))
+		}
+		alg := AHash
+		if i%3 == 0 {
+			alg = DHash
+		}
+		images = append(images, ImageEntry{Path: fmt.Sprintf("/img/%03d", i), Algorithm: alg, Hash: PerceptualHash(h), Digest: fmt.Sprintf("sha1:%d", i%200)})
+	}
+	// byte-exact duplicates alone are not a group
+	images = append(images,
+		ImageEntry{Path: "/exact/1", Algorithm: PHash, Hash: 42, Digest: "sha1:exact"},
+		ImageEntry{Path: "/exact/2", Algorithm: PHash, Hash: 42, Digest: "sha1:exact"})
+
+	for _, d := range []int{-1, 0, 1, 5, 10, 24, 63, 64, 100} {
+		got, want := GroupSimilar(images, d), bruteSimilar(images, d)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("distance %d: %d groups, want the %d of comparing every pair", d, len(got), len(want))
+		}
+		for _, g := range got {
+			if g.Files[0].Path == "/exact/1" {
+				t.Errorf("distance %d: byte-exact duplicates grouped", d)
+			}
+		}
+	}
+}
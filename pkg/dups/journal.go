@@ -0,0 +1,213 @@
+package dups
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// OpUndo is the operation of the journal entries of undone links
+const OpUndo = "undo"
+
+// JournalEntry is the record of a file replaced by a link, or of the undoing
+// of that
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Run  string    `json:"run"`
+	// Op is OpHardlink, OpSymlink, OpReflink or OpUndo
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	// Device, Inode, Mode, UID, GID and ModTime describe the file at Path
+	// before it was replaced, for undoing to restore them
+	Device  string      `json:"device,omitempty"`
+	Inode   uint64      `json:"inode,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	UID     *uint32     `json:"uid,omitempty"`
+	GID     *uint32     `json:"gid,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// Journal is an append-only log of the links made by a Linker, as JSON
+// lines, for them to be audited and undone
+type Journal struct {
+	// Run identifies the entries of one run
+	Run string
+
+	mu sync.Mutex
+	fh *os.File
+}
+
+// OpenJournal opens the journal file at path for appending, creating it if
+// need be
+func OpenJournal(path string) (*Journal, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{Run: runID(), fh: fh}, nil
+}
+
+// Append writes e to the journal, and syncs it to disk, so that no link is
+// left untraced by a crash. Its Time and Run are set when empty.
+func (j *Journal) Append(e JournalEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Run == "" {
+		e.Run = j.Run
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.fh.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	return j.fh.Sync()
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	return j.fh.Close()
+}
+
+// ReadJournal reads the entries of a journal, in the order they were written
+func ReadJournal(r io.Reader) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("journal line %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Undoable returns the links of entries that were not undone since, the
+// latest first. When run is set, only the links of that run are.
+func Undoable(entries []JournalEntry, run string) []JournalEntry {
+	// the latest link of each path, unless undone
+	latest := map[string]int{}
+	for i, e := range entries {
+		if e.Op == OpUndo {
+			delete(latest, e.Path)
+		} else {
+			latest[e.Path] = i
+		}
+	}
+	var links []JournalEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if j, ok := latest[e.Path]; ok && j == i && (run == "" || e.Run == run) {
+			links = append(links, e)
+		}
+	}
+	return links
+}
+
+// journal appends the link of path to target to the Journal of l, if set,
+// with prev the stat info of path before it was replaced
+func (l *Linker) journal(op, target, path, hash string, prev os.FileInfo) error {
+	if l.Journal == nil {
+		return nil
+	}
+	e := JournalEntry{
+		Op:      op,
+		Path:    path,
+		Target:  target,
+		Hash:    hash,
+		Size:    prev.Size(),
+		Mode:    prev.Mode(),
+		ModTime: prev.ModTime(),
+	}
+	if st, ok := statOf(prev); ok {
+		e.Device = formatDevice(st.dev)
+		e.Inode = st.ino
+		e.UID, e.GID = &st.uid, &st.gid
+	}
+	return l.Journal.Append(e)
+}
+
+// Undo breaks the link of e back into an independent copy of the content,
+// with the mode, owner and mtime the file had before. A *ChangedError is
+// returned when the content is no longer that of e, and a *SkipError when
+// the file is no longer the link that was made.
+func (e JournalEntry) Undo() error {
+	info, err := os.Lstat(e.Path)
+	if err != nil {
+		return err
+	}
+	switch e.Op {
+	case OpSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return &SkipError{Reason: fmt.Sprintf("%s is no longer a symlink", e.Path)}
+		}
+	case OpHardlink:
+		targetInfo, err := os.Stat(e.Target)
+		if err != nil || !os.SameFile(info, targetInfo) {
+			return &SkipError{Reason: fmt.Sprintf("%s is no longer a hardlink of %s", e.Path, e.Target)}
+		}
+	}
+	alg, _ := SplitDigest(e.Hash)
+	sum, err := hashFile(e.Path, alg)
+	if err != nil {
+		return err
+	}
+	if sum != e.Hash {
+		return &ChangedError{Path: e.Path, Want: e.Hash, Got: sum}
+	}
+
+	buf := make([]byte, 5)
+	if _, err = rand.Read(buf); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%x", e.Path, buf)
+	if err = copyFile(e.Path, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = restoreMetadata(tmp, e); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, e.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// restoreMetadata gives the file at path the mode, owner and mtime recorded
+// by e
+func restoreMetadata(path string, e JournalEntry) error {
+	if e.UID != nil && e.GID != nil {
+		if err := os.Lchown(path, int(*e.UID), int(*e.GID)); err != nil {
+			return err
+		}
+	}
+	if e.Mode != 0 {
+		if err := os.Chmod(path, e.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if !e.ModTime.IsZero() {
+		return os.Chtimes(path, e.ModTime, e.ModTime)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// journalScan links the duplicates of a new tree with l, and returns the tree
+// and the links of its journal
+func journalScan(t *testing.T, l *Linker) (string, []JournalEntry) {
+	t.Helper()
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "dup", "b": "dup", "c/d": "dup"})
+	if err := os.Chmod(filepath.Join(root, "b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "links.log")
+	journal, err := OpenJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Journal = journal
+	l.IgnoreAttributes = []Attribute{AttrMode}
+	s := newTestScanner(NewMapStore())
+	s.Linker = l
+	if _, err = s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	fh, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	entries, err := ReadJournal(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, Undoable(entries, journal.Run)
+}
+
+func TestJournalUndo(t *testing.T) {
+	for _, l := range []*Linker{{Hard: true}, {Symbolic: true}} {
+		root, links := journalScan(t, l)
+		if len(links) != 2 {
+			t.Fatalf("%d links journaled, want 2", len(links))
+		}
+		for _, e := range links {
+			if err := e.Undo(); err != nil {
+				t.Fatalf("Undo of %s: %v", e.Path, err)
+			}
+		}
+
+		a, err := os.Stat(filepath.Join(root, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"b", "c/d"} {
+			path := filepath.Join(root, name)
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.Mode().IsRegular() || os.SameFile(a, info) {
+				t.Errorf("%s is still a link of a after undoing", name)
+			}
+			if content, err := os.ReadFile(path); err != nil || string(content) != "dup" {
+				t.Errorf("%s has %q after undoing: %v", name, content, err)
+			}
+		}
+		if info, _ := os.Stat(filepath.Join(root, "b")); info.Mode().Perm() != 0600 {
+			t.Errorf("b has mode %s after undoing, want the -rw------- it had", info.Mode())
+		}
+	}
+}
+
+func TestJournalUndoChanged(t *testing.T) {
+	root, links := journalScan(t, &Linker{Hard: true})
+	// a write through one of the links changes the content of all of them
+	writeFiles(t, root, map[string]string{"a": "new"})
+	for _, e := range links {
+		err := e.Undo()
+		if _, ok := err.(*ChangedError); !ok {
+			t.Errorf("Undo of %s changed since: %v, want a *ChangedError", e.Path, err)
+		}
+	}
+	a, _ := os.Stat(filepath.Join(root, "a"))
+	if b, _ := os.Stat(filepath.Join(root, "b")); !os.SameFile(a, b) {
+		t.Error("b was undone after a change")
+	}
+
+	// a link replaced since is not undone
+	root, links = journalScan(t, &Linker{Hard: true})
+	if err := os.Remove(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{"b": "dup"})
+	for _, e := range links {
+		err := e.Undo()
+		if _, ok := err.(*SkipError); e.Path == filepath.Join(root, "b") && !ok {
+			t.Errorf("Undo of b no longer a link: %v, want a *SkipError", err)
+		}
+	}
+}
+
+func TestUndoable(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []JournalEntry{
+		{Time: at, Run: "1", Op: OpHardlink, Path: "/b"},
+		{Time: at, Run: "1", Op: OpHardlink, Path: "/c"},
+		{Time: at, Run: "2", Op: OpUndo, Path: "/b"},
+		{Time: at, Run: "3", Op: OpSymlink, Path: "/d"},
+		{Time: at, Run: "3", Op: OpHardlink, Path: "/c"},
+	}
+	paths := func(links []JournalEntry) []string {
+		var p []string
+		for _, e := range links {
+			p = append(p, e.Run+e.Path)
+		}
+		return p
+	}
+	if got := paths(Undoable(entries, "")); !reflect.DeepEqual(got, []string{"3/c", "3/d"}) {
+		t.Errorf("undoable %q, want the latest links of /c and /d", got)
+	}
+	if got := paths(Undoable(entries, "1")); got != nil {
+		t.Errorf("undoable of run 1 %q, want none", got)
+	}
+	if got := paths(Undoable(entries, "3")); !reflect.DeepEqual(got, []string{"3/c", "3/d"}) {
+		t.Errorf("undoable of run 3 %q", got)
+	}
+}
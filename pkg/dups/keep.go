@@ -0,0 +1,180 @@
+package dups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Criterion is a rule of a Keep policy, preferring one file of a group of
+// duplicates over another
+type Criterion string
+
+// The supported criteria
+const (
+	// KeepOldest prefers the file of the oldest mtime
+	KeepOldest Criterion = "oldest"
+	// KeepShortest prefers the file of the shortest path
+	KeepShortest Criterion = "shortest"
+	// KeepPrefix prefers the file under the earliest of the Keep Prefixes
+	KeepPrefix Criterion = "prefix"
+	// KeepLinks prefers the file with the most hardlinks already
+	KeepLinks Criterion = "links"
+)
+
+// Criteria lists the supported criteria
+func Criteria() []Criterion {
+	return []Criterion{KeepOldest, KeepShortest, KeepPrefix, KeepLinks}
+}
+
+// Keep is the policy choosing which file of a group of duplicates is kept,
+// for the others to be linked to it. Files are compared by each of the
+// Criteria in turn, then the file already kept by an earlier scan of the
+// Scanner is preferred, and then the first by path, so that the choice does
+// not depend on the order the files were hashed or recorded in.
+type Keep struct {
+	Criteria []Criterion
+	// Prefixes are the directories of KeepPrefix, in order of preference
+	Prefixes []string
+}
+
+// ParseKeep makes a Keep policy of a comma-separated list of criteria, and
+// the directories to prefer. When there are prefixes but no KeepPrefix
+// criterion, it is applied first.
+func ParseKeep(criteria string, prefixes []string) (*Keep, error) {
+	k := &Keep{}
+	hasPrefix := false
+	for _, name := range strings.Split(criteria, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		c, ok := parseCriterion(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown keep criterion %q", name)
+		}
+		if c == KeepPrefix {
+			hasPrefix = true
+		}
+		k.Criteria = append(k.Criteria, c)
+	}
+	if len(prefixes) > 0 {
+		clean, err := CleanPaths(prefixes)
+		if err != nil {
+			return nil, err
+		}
+		k.Prefixes = clean
+		if !hasPrefix {
+			k.Criteria = append([]Criterion{KeepPrefix}, k.Criteria...)
+		}
+	} else if hasPrefix {
+		return nil, fmt.Errorf("keep criterion %q needs prefixes", KeepPrefix)
+	}
+	return k, nil
+}
+
+func parseCriterion(name string) (Criterion, bool) {
+	for _, c := range Criteria() {
+		if string(c) == name {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// member is a file of a group of duplicates, as the Keep policy sees it
+type member struct {
+	path string
+	info os.FileInfo
+	fs   string
+	// earlier is set for the file kept by an earlier scan of the Scanner
+	earlier bool
+	// fixed is set for a file whose record is too old to replace it by a link
+	fixed bool
+	// seen is set for the files of the current scan, and hashed for those of
+	// them whose record is new
+	seen   bool
+	hashed bool
+	// trashed is set once the file is moved to the Trash of the Linker
+	trashed bool
+	// archive is the stat info of the archive of a member, which is never
+	// kept nor linked
+	archive os.FileInfo
+}
+
+// seedMember is the member of a loaded record, before its file is checked
+func seedMember(e *Entry) *member {
+	return &member{path: e.Path, info: entryInfo{e}}
+}
+
+// entryInfo is the os.FileInfo of a record, as far as it is known
+type entryInfo struct{ e *Entry }
+
+func (fi entryInfo) Name() string       { return filepath.Base(fi.e.Path) }
+func (fi entryInfo) Size() int64        { return fi.e.Size }
+func (fi entryInfo) Mode() os.FileMode  { return 0 }
+func (fi entryInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi entryInfo) IsDir() bool        { return false }
+func (fi entryInfo) Sys() interface{}   { return nil }
+
+// less reports whether a is to be kept over b. A nil Keep only applies the
+// tie breakers.
+func (k *Keep) less(a, b *member) bool {
+	if k != nil {
+		for _, c := range k.Criteria {
+			if r := k.compare(c, a, b); r != 0 {
+				return r < 0
+			}
+		}
+	}
+	if a.earlier != b.earlier {
+		return a.earlier
+	}
+	return a.path < b.path
+}
+
+// compare a and b by c, returning a negative number when a is preferred
+func (k *Keep) compare(c Criterion, a, b *member) int {
+	switch c {
+	case KeepOldest:
+		at, bt := a.info.ModTime(), b.info.ModTime()
+		if at.Before(bt) {
+			return -1
+		} else if bt.Before(at) {
+			return 1
+		}
+	case KeepShortest:
+		return len(a.path) - len(b.path)
+	case KeepPrefix:
+		return k.prefixRank(a.path) - k.prefixRank(b.path)
+	case KeepLinks:
+		al, bl := links(a.info), links(b.info)
+		if al > bl {
+			return -1
+		} else if al < bl {
+			return 1
+		}
+	}
+	return 0
+}
+
+// prefixRank is the index of the first of the Prefixes that path is under
+func (k *Keep) prefixRank(path string) int {
+	for i, prefix := range k.Prefixes {
+		rel, err := filepath.Rel(prefix, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return i
+		}
+	}
+	return len(k.Prefixes)
+}
+
+// links is the number of hardlinks of a file, or 1 when it is not known
+func links(info os.FileInfo) uint64 {
+	if st, ok := statOf(info); ok {
+		return st.nlink
+	}
+	return 1
+}
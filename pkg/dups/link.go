@@ -0,0 +1,222 @@
+package dups
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Linker replaces duplicate files with links to the file of the same content
+type Linker struct {
+	// Hard enables replacing duplicates with hardlinks
+	Hard bool
+	// Symbolic enables replacing duplicates with symlinks
+	Symbolic bool
+	// Reflink enables sharing the extents of duplicates on copy-on-write
+	// filesystems (like btrfs and XFS), leaving them independent files
+	Reflink bool
+	// Journal, if set, records each link made
+	Journal *Journal
+	// Trash, if set, moves duplicates into a quarantine directory instead
+	Trash *Trash
+	// Recorder, if set, records the moves to the Trash made by Apply
+	Recorder TrashRecorder
+	// AllowedPaths, if not empty, restricts hardlinking to files within these
+	// paths
+	AllowedPaths []string
+	// IgnoreAttributes are left out of CheckMetadata, letting hard and
+	// symbolic links change them
+	IgnoreAttributes []Attribute
+}
+
+// SkipError reports why a pair of files was not linked
+type SkipError struct {
+	Reason string
+}
+
+func (e *SkipError) Error() string {
+	return e.Reason
+}
+
+// CleanPaths converts a list of paths to cleaned absolute paths, as used for
+// Linker.AllowedPaths
+func CleanPaths(paths []string) ([]string, error) {
+	var clean []string
+	for _, path := range paths {
+		cleanPath := filepath.Clean(strings.TrimSpace(path))
+		if !filepath.IsAbs(cleanPath) {
+			absPath, err := filepath.Abs(cleanPath)
+			if err != nil {
+				return clean, fmt.Errorf("converting path to absolute: %s, %v", cleanPath, err)
+			}
+			cleanPath = absPath
+		}
+		clean = append(clean, cleanPath)
+	}
+	return clean, nil
+}
+
+// Hardlink replaces path with a hardlink to target. A *SkipError is returned
+// when the files are on different devices or outside of the AllowedPaths, and
+// a *MismatchError when their metadata differs.
+func (l *Linker) Hardlink(target, path string, info os.FileInfo) error {
+	if err := l.CheckHardlink(target, path, info); err != nil {
+		return err
+	}
+	if err := l.CheckMetadata(target, path); err != nil {
+		return err
+	}
+	return SafeLink(target, path, true)
+}
+
+// CheckHardlink returns a *SkipError if path can not be replaced with a
+// hardlink to target, as they are on different filesystems or mounts
+func (l *Linker) CheckHardlink(target, path string, info os.FileInfo) error {
+	currentStat, ok := statOf(info)
+	if !ok {
+		return &SkipError{Reason: fmt.Sprintf("could not get device info for %s", path)}
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return &SkipError{Reason: fmt.Sprintf("could not stat target file %s", target)}
+	}
+	targetStat, ok := statOf(targetInfo)
+	if !ok {
+		return &SkipError{Reason: fmt.Sprintf("could not get device info for target file %s", target)}
+	}
+	// Only hardlink if both files are on the same device, which also tells
+	// apart btrfs subvolumes
+	if currentStat.dev != targetStat.dev {
+		return &SkipError{Reason: fmt.Sprintf("files on different devices (%s vs %s)",
+			formatDevice(currentStat.dev), formatDevice(targetStat.dev))}
+	}
+	// and on the same mount, as bind mounts of a filesystem share its device
+	currentMount, targetMount := mountOf(path), mountOf(target)
+	if currentMount != nil && targetMount != nil && currentMount.id != targetMount.id {
+		return &SkipError{Reason: fmt.Sprintf("files on different mounts (%s vs %s)", currentMount.point, targetMount.point)}
+	}
+	if !isPathAllowed(path, l.AllowedPaths) || !isPathAllowed(target, l.AllowedPaths) {
+		return &SkipError{Reason: fmt.Sprintf("file(s) not in allowed paths (current: %s, target: %s)", path, target)}
+	}
+	return nil
+}
+
+// SameFilesystem reports whether the Linker can only link files that are on
+// the same filesystem
+func (l *Linker) SameFilesystem() bool {
+	return l.Hard || l.Reflink
+}
+
+// filesystem identifies the filesystem, and the mount of it, that path is on
+func filesystem(path string, info os.FileInfo) string {
+	fs := NewEntry(path, "", info).DeviceID
+	if m := mountOf(path); m != nil {
+		fs += " " + strconv.Itoa(m.id)
+	}
+	return fs
+}
+
+// Symlink replaces path with a relative symlink to target. A *MismatchError
+// is returned when their metadata differs.
+func (l *Linker) Symlink(target, path string) error {
+	if err := l.CheckMetadata(target, path); err != nil {
+		return err
+	}
+	return SafeLink(target, path, false)
+}
+
+// ReflinkFile makes path share the data extents of target, once the kernel
+// confirms their content is identical. A *SkipError is returned when the
+// filesystem does not support it.
+func (l *Linker) ReflinkFile(target, path string) error {
+	return reflink(target, path)
+}
+
+// isPathAllowed checks if a path is within any of the allowed paths
+func isPathAllowed(path string, allowedPaths []string) bool {
+	if len(allowedPaths) == 0 {
+		// If no allowed paths specified, all paths are allowed
+		return true
+	}
+
+	// Clean the path for comparison
+	cleanPath := filepath.Clean(path)
+
+	for _, allowedPath := range allowedPaths {
+		// Convert allowed path to absolute path if it's not already
+		absAllowedPath := allowedPath
+		if !filepath.IsAbs(allowedPath) {
+			var err error
+			absAllowedPath, err = filepath.Abs(allowedPath)
+			if err != nil {
+				continue
+			}
+		}
+
+		// Check if the path is within the allowed path
+		rel, err := filepath.Rel(absAllowedPath, cleanPath)
+		if err != nil {
+			continue
+		}
+		// If the relative path doesn't start with "..", it's within the allowed path
+		if !strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeLink overrides newname if it already exists. If there is an error in creating the link, the transaction is rolled back
+func SafeLink(oldname, newname string, hard bool) error {
+	var backupName string
+	// check if newname exists
+	if fi, err := os.Stat(newname); err == nil && fi != nil {
+		// make a random name
+		buf := make([]byte, 5)
+		if _, err = rand.Read(buf); err != nil {
+			return err
+		}
+		backupName = fmt.Sprintf("%s.%x", newname, buf)
+		// move newname to the random name backupName
+		if err = os.Rename(newname, backupName); err != nil {
+			return err
+		}
+	}
+	if hard {
+		// hardlink oldname to newname
+		if err := os.Link(oldname, newname); err != nil {
+			// if that failed, and there is a backupName
+			if len(backupName) > 0 {
+				// then move back the backup
+				if rerr := os.Rename(backupName, newname); rerr != nil {
+					return rerr
+				}
+			}
+			return err
+		}
+	} else {
+		// symlink
+		relpath, err := filepath.Rel(filepath.Dir(newname), oldname)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(relpath, newname); err != nil {
+			// if that failed, and there is a backupName
+			if len(backupName) > 0 {
+				// then move back the backup
+				if rerr := os.Rename(backupName, newname); rerr != nil {
+					return rerr
+				}
+			}
+			return err
+		}
+	}
+	// remove the backupName
+	if len(backupName) > 0 {
+		os.Remove(backupName)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHardlink(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content", "b": "content"})
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	info, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Linker{Hard: true}
+	if err = l.Hardlink(a, b, info); err != nil {
+		t.Fatal(err)
+	}
+	ai, _ := os.Stat(a)
+	bi, _ := os.Stat(b)
+	if !os.SameFile(ai, bi) {
+		t.Errorf("%s is not a hardlink of %s", b, a)
+	}
+	// the file replaced is not left behind under another name
+	if entries, _ := os.ReadDir(root); len(entries) != 2 {
+		t.Errorf("%d files left, want 2", len(entries))
+	}
+}
+
+func TestHardlinkAllowedPaths(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"in/a": "content", "out/b": "content"})
+	a, b := filepath.Join(root, "in/a"), filepath.Join(root, "out/b")
+	info, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Linker{Hard: true, AllowedPaths: []string{filepath.Join(root, "in")}}
+	err = l.Hardlink(a, b, info)
+	if _, ok := err.(*SkipError); !ok {
+		t.Fatalf("Hardlink out of the allowed paths: %v, want a SkipError", err)
+	}
+	ai, _ := os.Stat(a)
+	bi, _ := os.Stat(b)
+	if os.SameFile(ai, bi) {
+		t.Errorf("%s was linked out of the allowed paths", b)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content", "sub/b": "content"})
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "sub/b")
+	if err := (&Linker{Symbolic: true}).Symlink(a, b); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := os.Readlink(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != filepath.Join("..", "a") {
+		t.Errorf("symlink to %q, want the relative path ../a", dest)
+	}
+	if content, err := os.ReadFile(b); err != nil || string(content) != "content" {
+		t.Errorf("read %q through the symlink: %v", content, err)
+	}
+}
+
+func TestScanHardlinks(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "dup", "b": "dup", "c/d": "dup", "e": "one"})
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Linker = &Linker{Hard: true}
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	ai, _ := os.Stat(filepath.Join(root, "a"))
+	for _, name := range []string{"b", "c/d"} {
+		if info, _ := os.Stat(filepath.Join(root, name)); !os.SameFile(ai, info) {
+			t.Errorf("%s is not a hardlink of a", name)
+		}
+	}
+	if ei, _ := os.Stat(filepath.Join(root, "e")); os.SameFile(ai, ei) {
+		t.Error("e was linked to a")
+	}
+	if st := s.Stats(); st.BytesReclaimed != 2*int64(len("dup")) {
+		t.Errorf("reclaimed %d bytes, want %d", st.BytesReclaimed, 2*len("dup"))
+	}
+
+	// the links are recorded, and count as a single copy
+	groups, err := DuplicateGroups(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups {
+		if g.Copies() != 1 || g.Reclaimable() != 0 {
+			t.Errorf("group %s of %d copies, %d reclaimable, want 1 and 0", g.Hash, g.Copies(), g.Reclaimable())
+		}
+	}
+}
+
+func TestApplyNotCollisionResistant(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content", "b": "content"})
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	sum, err := hashFile(a, XXHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Linker{}).Apply(Action{Op: OpHardlink, Path: b, Target: a, Hash: sum})
+	if _, ok := err.(*SkipError); !ok {
+		t.Fatalf("Apply of a hardlink on an xxhash match: %v, want a SkipError", err)
+	}
+	ai, _ := os.Stat(a)
+	bi, _ := os.Stat(b)
+	if os.SameFile(ai, bi) {
+		t.Error("linked on an xxhash match")
+	}
+}
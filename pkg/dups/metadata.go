@@ -0,0 +1,133 @@
+package dups
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Attribute names the metadata of a file that linking would change
+type Attribute string
+
+// The attributes compared before linking. Xattrs include the ACLs of a file.
+const (
+	AttrUID    Attribute = "uid"
+	AttrGID    Attribute = "gid"
+	AttrMode   Attribute = "mode"
+	AttrXattrs Attribute = "xattrs"
+)
+
+// Attributes lists the attributes compared before linking
+func Attributes() []Attribute {
+	return []Attribute{AttrUID, AttrGID, AttrMode, AttrXattrs}
+}
+
+// ParseAttributes validates a comma-separated list of attribute names
+func ParseAttributes(s string) ([]Attribute, error) {
+	var attrs []Attribute
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, a := range Attributes() {
+			if string(a) == name {
+				attrs = append(attrs, a)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown attribute %q", name)
+		}
+	}
+	return attrs, nil
+}
+
+// MismatchError reports a pair of files that was not linked, as the metadata
+// of Path would have changed to that of Target
+type MismatchError struct {
+	Target string
+	Path   string
+	// Diffs describe each attribute that differs
+	Diffs []string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("metadata of %s differs from %s (%s)", e.Path, e.Target, strings.Join(e.Diffs, ", "))
+}
+
+// CheckMetadata returns a *MismatchError if the owner, mode or xattrs of path
+// differ from those of target, other than the attributes the Linker ignores
+func (l *Linker) CheckMetadata(target, path string) error {
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	targetStat, ok1 := statOf(targetInfo)
+	st, ok2 := statOf(info)
+	if ok1 && ok2 {
+		if !l.ignores(AttrUID) && st.uid != targetStat.uid {
+			diffs = append(diffs, fmt.Sprintf("uid %d, not %d", st.uid, targetStat.uid))
+		}
+		if !l.ignores(AttrGID) && st.gid != targetStat.gid {
+			diffs = append(diffs, fmt.Sprintf("gid %d, not %d", st.gid, targetStat.gid))
+		}
+	}
+	const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if mode, targetMode := info.Mode()&modeBits, targetInfo.Mode()&modeBits; !l.ignores(AttrMode) && mode != targetMode {
+		diffs = append(diffs, fmt.Sprintf("mode %s, not %s", mode, targetMode))
+	}
+	if !l.ignores(AttrXattrs) {
+		x, err := xattrs(path)
+		if err != nil {
+			return err
+		}
+		targetX, err := xattrs(target)
+		if err != nil {
+			return err
+		}
+		if names := diffXattrs(x, targetX); len(names) > 0 {
+			diffs = append(diffs, fmt.Sprintf("xattrs %s", strings.Join(names, " ")))
+		}
+	}
+	if len(diffs) > 0 {
+		return &MismatchError{Target: target, Path: path, Diffs: diffs}
+	}
+	return nil
+}
+
+// ignores reports whether a is left out of CheckMetadata
+func (l *Linker) ignores(a Attribute) bool {
+	for _, ignored := range l.IgnoreAttributes {
+		if ignored == a {
+			return true
+		}
+	}
+	return false
+}
+
+// diffXattrs returns the sorted names of the xattrs that a and b do not
+// share the same value of
+func diffXattrs(a, b map[string]string) []string {
+	var names []string
+	for name, value := range a {
+		if v, ok := b[name]; !ok || v != value {
+			names = append(names, name)
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
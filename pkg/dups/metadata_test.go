@@ -0,0 +1,149 @@
+package dups
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ignore []Attribute
+		// change sets the metadata of the path, leaving the target's alone
+		change func(path string) error
+		root   bool
+		xattr  bool
+		// diff is the start of the only Diff of the MismatchError, if any
+		diff string
+	}{
+		{name: "same", change: func(string) error { return nil }},
+		{name: "mode", change: func(path string) error { return os.Chmod(path, 0600) }, diff: "mode -rw-------, not -rw-r--r--"},
+		{name: "setgid", change: func(path string) error { return os.Chmod(path, 0644|os.ModeSetgid) }, diff: "mode g"},
+		{name: "mode ignored", ignore: []Attribute{AttrMode}, change: func(path string) error { return os.Chmod(path, 0600) }},
+		{name: "uid", root: true, change: func(path string) error { return os.Chown(path, 1234, -1) }, diff: "uid 1234, not 0"},
+		{name: "gid", root: true, change: func(path string) error { return os.Chown(path, -1, 1234) }, diff: "gid 1234, not 0"},
+		{name: "uid ignored", root: true, ignore: []Attribute{AttrUID}, change: func(path string) error { return os.Chown(path, 1234, -1) }},
+		{name: "xattr", xattr: true, change: func(path string) error { return setxattr(path, "user.dups", "b") }, diff: "xattrs user.dups"},
+		{name: "xattr ignored", xattr: true, ignore: []Attribute{AttrXattrs}, change: func(path string) error { return setxattr(path, "user.dups", "b") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.root && os.Getuid() != 0 {
+				t.Skip("changing the owner needs root")
+			}
+			root := t.TempDir()
+			writeFiles(t, root, map[string]string{"target": "x", "path": "x"})
+			target, path := filepath.Join(root, "target"), filepath.Join(root, "path")
+			for _, p := range []string{target, path} {
+				if err := os.Chmod(p, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.xattr && setxattr(target, "user.dups", "a") != nil {
+				t.Skip("the filesystem has no user xattrs")
+			}
+			if err := tc.change(path); err != nil {
+				t.Fatal(err)
+			}
+
+			err := (&Linker{Hard: true, IgnoreAttributes: tc.ignore}).CheckMetadata(target, path)
+			if tc.diff == "" {
+				if err != nil {
+					t.Errorf("CheckMetadata: %v", err)
+				}
+				return
+			}
+			var mismatch *MismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("CheckMetadata: %v, want a *MismatchError", err)
+			}
+			if mismatch.Target != target || mismatch.Path != path {
+				t.Errorf("mismatch of %s and %s, want %s and %s", mismatch.Path, mismatch.Target, path, target)
+			}
+			if len(mismatch.Diffs) != 1 || !strings.HasPrefix(mismatch.Diffs[0], tc.diff) {
+				t.Errorf("diffs %q, want one starting with %q", mismatch.Diffs, tc.diff)
+			}
+		})
+	}
+}
+
+func TestDiffXattrs(t *testing.T) {
+	for _, tc := range []struct {
+		a, b map[string]string
+		want []string
+	}{
+		{nil, nil, nil},
+		{map[string]string{"user.a": "1"}, map[string]string{"user.a": "1"}, nil},
+		{map[string]string{"user.a": "1"}, map[string]string{"user.a": "2"}, []string{"user.a"}},
+		{map[string]string{"user.b": "1"}, nil, []string{"user.b"}},
+		{nil, map[string]string{"user.b": "1"}, []string{"user.b"}},
+		{map[string]string{"user.b": "1", "user.c": "1"}, map[string]string{"user.a": "", "user.c": "1"}, []string{"user.a", "user.b"}},
+	} {
+		if got := diffXattrs(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("diffXattrs(%v, %v) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attrs, err := ParseAttributes(" UID,mode,,xattrs")
+	if err != nil || !reflect.DeepEqual(attrs, []Attribute{AttrUID, AttrMode, AttrXattrs}) {
+		t.Errorf("ParseAttributes = %q, %v", attrs, err)
+	}
+	if _, err = ParseAttributes("uid,size"); err == nil {
+		t.Error("ParseAttributes took an unknown attribute")
+	}
+}
+
+func TestScanMismatched(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ignore []Attribute
+		linked bool
+	}{
+		{name: "skipped"},
+		{name: "ignored", ignore: []Attribute{AttrMode}, linked: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFiles(t, root, map[string]string{"a": "dup", "b": "dup"})
+			a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+			if err := os.Chmod(a, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestScanner(NewMapStore())
+			s.Linker = &Linker{Hard: true, IgnoreAttributes: tc.ignore}
+			if _, err := s.Scan(root); err != nil {
+				t.Fatal(err)
+			}
+
+			ai, _ := os.Stat(a)
+			bi, _ := os.Stat(b)
+			if linked := os.SameFile(ai, bi); linked != tc.linked {
+				t.Errorf("linked %v, want %v", linked, tc.linked)
+			}
+			var mismatched []*MismatchError
+			for _, errs := range s.Mismatched() {
+				mismatched = append(mismatched, errs...)
+			}
+			if tc.linked {
+				if len(mismatched) != 0 {
+					t.Errorf("mismatched %v, want none", mismatched)
+				}
+				return
+			}
+			if len(mismatched) != 1 || mismatched[0].Path != b || mismatched[0].Target != a {
+				t.Errorf("mismatched %v, want b of a", mismatched)
+			}
+			if st := s.Stats(); st.BytesReclaimed != 0 {
+				t.Errorf("reclaimed %d bytes of a skipped link", st.BytesReclaimed)
+			}
+		})
+	}
+}
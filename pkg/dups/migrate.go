@@ -0,0 +1,185 @@
+package dups
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration upgrades the schema of a database to its version, from the one
+// before it. Databases from before the schema_version table have no version,
+// and may have any of the columns added by the early migrations, so those
+// check for what is already there.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations are the versions of the schema, in order
+var migrations = []migration{
+	{1, "file_hashes table", execSQL(`CREATE TABLE IF NOT EXISTS file_hashes (
+	id INTEGER PRIMARY KEY,
+	hash TEXT NOT NULL,
+	file_path TEXT NOT NULL UNIQUE,
+	device_id TEXT,  -- Store device ID as string (major:minor)
+	size INTEGER,
+	modified_time DATETIME,
+	checked_time DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_hash ON file_hashes(hash);
+CREATE INDEX IF NOT EXISTS idx_file_path ON file_hashes(file_path);
+CREATE INDEX IF NOT EXISTS idx_device_id ON file_hashes(device_id);
+CREATE INDEX IF NOT EXISTS idx_checked_time ON file_hashes(checked_time);`)},
+	{2, "inode of files", addColumn("file_hashes", "inode", "INTEGER")},
+	// the hashes from before the algorithm was recorded are all SHA1
+	{3, "hash algorithm", addColumn("file_hashes", "algorithm", "TEXT NOT NULL DEFAULT 'sha1'")},
+	{4, "ctime of files", addColumn("file_hashes", "changed_time", "DATETIME")},
+	{5, "scan_errors table", execSQL(`CREATE TABLE IF NOT EXISTS scan_errors (
+	id INTEGER PRIMARY KEY,
+	file_path TEXT NOT NULL,
+	op TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	message TEXT NOT NULL,
+	occurred_time DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_scan_errors_file_path ON scan_errors(file_path);`)},
+	{6, "trash table", execSQL(`CREATE TABLE IF NOT EXISTS trash (
+	id INTEGER PRIMARY KEY,
+	run TEXT NOT NULL,
+	file_path TEXT NOT NULL,
+	trash_path TEXT NOT NULL,
+	target TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	size INTEGER,
+	moved_time DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_trash_run ON trash(run);`)},
+	{7, "image_hashes table", execSQL(`CREATE TABLE IF NOT EXISTS image_hashes (
+	id INTEGER PRIMARY KEY,
+	file_path TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	hash TEXT NOT NULL,  -- 16 hex digits
+	size INTEGER,
+	modified_time DATETIME,
+	changed_time DATETIME,
+	checked_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (file_path, algorithm)
+);`)},
+	{8, "chunk tables", execSQL(`CREATE TABLE IF NOT EXISTS chunked_files (
+	id INTEGER PRIMARY KEY,
+	file_path TEXT NOT NULL,
+	params TEXT NOT NULL,  -- min-avg-max chunk sizes
+	size INTEGER,
+	modified_time DATETIME,
+	changed_time DATETIME,
+	checked_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (file_path, params)
+);
+CREATE TABLE IF NOT EXISTS chunks (
+	file_id INTEGER NOT NULL,
+	offset INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_chunks_file_id ON chunks(file_id);
+CREATE INDEX IF NOT EXISTS idx_chunks_hash ON chunks(hash);`)},
+}
+
+// SchemaVersion is the latest version of the database schema
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the schema of the database
+func (s *SQLiteStore) SchemaVersion() (int, error) {
+	return schemaVersion(s.DB)
+}
+
+// migrate applies the migrations the database has not had yet, each in its
+// own transaction
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	description TEXT,
+	applied_time DATETIME DEFAULT CURRENT_TIMESTAMP
+)`); err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the supported %d", current, SchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to schema version %d (%s): %v", m.version, m.description, err)
+		}
+		if _, err = tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", m.version, m.description); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the latest version applied to db, or 0
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// execSQL is a migration of plain statements
+func execSQL(stmts string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmts)
+		return err
+	}
+}
+
+// addColumn is a migration adding column to table, unless the table already
+// has it
+func addColumn(table, column, decl string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				cid         int
+				name, ctype string
+				notnull, pk int
+				dflt        interface{}
+			)
+			if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+				return err
+			}
+			if name == column {
+				return nil
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+		return err
+	}
+}
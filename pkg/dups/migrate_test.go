@@ -0,0 +1,231 @@
+package dups
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// baselineSchema is the schema of the databases written before the schema
+// was versioned
+const baselineSchema = `CREATE TABLE IF NOT EXISTS file_hashes (
+	id INTEGER PRIMARY KEY,
+	hash TEXT NOT NULL,
+	file_path TEXT NOT NULL UNIQUE,
+	device_id TEXT,  -- Store device ID as string (major:minor)
+	size INTEGER,
+	modified_time DATETIME,
+	checked_time DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_hash ON file_hashes(hash);
+CREATE INDEX IF NOT EXISTS idx_file_path ON file_hashes(file_path);
+CREATE INDEX IF NOT EXISTS idx_device_id ON file_hashes(device_id);
+CREATE INDEX IF NOT EXISTS idx_checked_time ON file_hashes(checked_time);`
+
+// baselineDB writes a database of the baseline schema, with the rows of a
+// scan and of an import of a JSON hash map, and returns its path
+func baselineDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "baseline.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]interface{}{
+		// scanned, with the major device number alone
+		{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "/a", "8", 0, "2020-01-02 03:04:05"},
+		{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "/b", "8", 0, "2020-01-02 03:04:06"},
+		// imported from a JSON hash map
+		{"356a192b7913b04c54574d18c28d46e6395428ab", "/c", "", nil, nil},
+	} {
+		if _, err = db.Exec("INSERT INTO file_hashes (hash, file_path, device_id, size, modified_time) VALUES (?, ?, ?, ?, ?)", row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	path := baselineDB(t)
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Errorf("schema version %d, want %d", version, SchemaVersion())
+	}
+
+	e, ok, err := db.Get("/b")
+	if err != nil || !ok {
+		t.Fatalf("Get of a migrated row: %v, %v", ok, err)
+	}
+	// the hashes from before the algorithm was recorded are SHA1
+	if e.Hash != "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709" || e.Size != 0 || e.DeviceID != "8" {
+		t.Errorf("migrated row %+v", e)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC); !e.ModTime.Equal(want) {
+		t.Errorf("migrated mtime %s, want %s", e.ModTime, want)
+	}
+	if _, ok, _ = db.Get("/c"); ok {
+		t.Error("the imported row without a size is usable")
+	}
+	var paths []string
+	if err = db.Each(func(e Entry) error {
+		paths = append(paths, e.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 {
+		t.Errorf("rows %q after migrating, want /a, /b and /c", paths)
+	}
+
+	// the new columns are usable
+	e.Inode, e.CTime = 42, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = db.Put(e); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := db.Get("/b"); got.Inode != 42 || !got.CTime.Equal(e.CTime) {
+		t.Errorf("row %+v after Put, want inode 42 and ctime %s", got, e.CTime)
+	}
+}
+
+func TestMigrateReopen(t *testing.T) {
+	path := baselineDB(t)
+	for i := 0; i < 2; i++ {
+		db, err := OpenSQLite(path)
+		if err != nil {
+			t.Fatalf("opening #%d: %v", i+1, err)
+		}
+		var applied int
+		if err = db.DB.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if applied != len(migrations) {
+			t.Errorf("%d migrations recorded after opening #%d, want %d", applied, i+1, len(migrations))
+		}
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB.Exec("INSERT INTO schema_version (version, description) VALUES (?, 'from the future')", SchemaVersion()+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenSQLite(path); err == nil {
+		db.Close()
+		t.Error("opened a database of a newer schema")
+	}
+}
+
+func TestOpenSQLiteReadOnly(t *testing.T) {
+	if _, err := OpenSQLiteReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("opened a missing database")
+	}
+
+	// a database of an older schema is not upgraded
+	path := baselineDB(t)
+	if db, err := OpenSQLiteReadOnly(path); err == nil {
+		db.Close()
+		t.Error("opened a database of the baseline schema")
+	}
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	err = raw.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_version'").Scan(&tables)
+	raw.Close()
+	if err != nil || tables != 0 {
+		t.Errorf("baseline database migrated by a read-only open: %v", err)
+	}
+
+	path = filepath.Join(t.TempDir(), "hashes.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put(Entry{Hash: "sha256:aa", Path: "/a", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if db, err = OpenSQLiteReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if e, ok, err := db.Get("/a"); err != nil || !ok || e.Hash != "sha256:aa" {
+		t.Errorf("Get of a read-only database: %+v, %v, %v", e, ok, err)
+	}
+	if err = db.Put(Entry{Hash: "sha256:bb", Path: "/b", Size: 1}); err == nil {
+		t.Error("wrote to a read-only database")
+	}
+}
+
+func TestPruneMigrated(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"same": "x", "grown": "x", "touched": "x"})
+	path := filepath.Join(t.TempDir(), "baseline.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = raw.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	// rows as the baseline wrote them, of the major device number and the
+	// mtime to the second, before the files changed
+	for _, name := range []string{"same", "grown", "touched"} {
+		file := filepath.Join(root, name)
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		major, _, _ := strings.Cut(NewEntry(file, "", info).DeviceID, ":")
+		if _, err = raw.Exec("INSERT INTO file_hashes (hash, file_path, device_id, size, modified_time) VALUES (?, ?, ?, ?, ?)",
+			"11f6ad8ec52a2984abaafd7c3b516503785c2072", file, major, info.Size(), info.ModTime().UTC().Format("2006-01-02 15:04:05")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+	writeFiles(t, root, map[string]string{"grown": "xx"})
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(filepath.Join(root, "touched"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pruned, err := db.Prune(time.Time{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range pruned {
+		got = append(got, filepath.Base(r.Path))
+	}
+	if len(got) != 2 || got[0] != "grown" || got[1] != "touched" {
+		t.Errorf("pruned %q of the migrated rows, want grown and touched", got)
+	}
+}
@@ -0,0 +1,104 @@
+package dups
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// mount is a line of /proc/self/mountinfo
+type mount struct {
+	id     int
+	device string
+	root   string
+	point  string
+}
+
+var (
+	mountsOnce sync.Once
+	mounts     []mount
+)
+
+// mountOf returns the mount that path is on, or nil if the mount table is not
+// available. Bind mounts of the same filesystem share a device ID, but
+// hardlinks between them still fail, so files are compared by mount too.
+func mountOf(path string) *mount {
+	mountsOnce.Do(func() {
+		mounts, _ = readMountInfo("/proc/self/mountinfo")
+	})
+	if len(mounts) == 0 {
+		return nil
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		path = filepath.Join(dir, filepath.Base(path))
+	}
+	// mounts are sorted with the longest mount points first, and the later
+	// of stacked mounts first
+	for i := range mounts {
+		m := &mounts[i]
+		if m.point == "/" || path == m.point || strings.HasPrefix(path, m.point+"/") {
+			return m
+		}
+	}
+	return nil
+}
+
+// readMountInfo parses a mountinfo file, as described in proc(5)
+func readMountInfo(path string) ([]mount, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var table []mount
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		table = append(table, mount{
+			id:     id,
+			device: fields[2],
+			root:   unescapeMountPath(fields[3]),
+			point:  unescapeMountPath(fields[4]),
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(table)-1; i < j; i, j = i+1, j-1 {
+		table[i], table[j] = table[j], table[i]
+	}
+	sort.SliceStable(table, func(i, j int) bool { return len(table[i].point) > len(table[j].point) })
+	return table, nil
+}
+
+// unescapeMountPath decodes the octal escapes (like \040 for a space) of the
+// paths of mountinfo
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
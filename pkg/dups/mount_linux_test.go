@@ -0,0 +1,66 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040disk`, "/mnt/my disk"},
+		{`/mnt/tab\011and\012newline`, "/mnt/tab\tand\nnewline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		// not escapes: too short, or not octal
+		{`/mnt/end\04`, `/mnt/end\04`},
+		{`/mnt/x\999`, `/mnt/x\999`},
+		{`\040\040`, "  "},
+	} {
+		if got := unescapeMountPath(tt.in); got != tt.want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadMountInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	err := os.WriteFile(path, []byte(`22 1 253:0 / / rw,relatime shared:1 - ext4 /dev/mapper/root rw
+30 22 253:1 / /srv rw,relatime shared:2 - xfs /dev/mapper/srv rw
+31 22 253:1 /export/share /mnt/my\040share rw,relatime shared:2 - xfs /dev/mapper/srv rw
+32 30 0:45 / /srv/tmp rw - tmpfs tmpfs rw
+33 30 0:46 / /srv/tmp rw - tmpfs tmpfs rw
+bad line
+x 1 8:1 / /bad rw - ext4 /dev/sda1 rw
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := readMountInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mount{
+		// the longest mount points first, and the later of stacked mounts
+		{id: 31, device: "253:1", root: "/export/share", point: "/mnt/my share"},
+		{id: 33, device: "0:46", root: "/", point: "/srv/tmp"},
+		{id: 32, device: "0:45", root: "/", point: "/srv/tmp"},
+		// the bind mount above shares the device of this one
+		{id: 30, device: "253:1", root: "/", point: "/srv"},
+		{id: 22, device: "253:0", root: "/", point: "/"},
+	}
+	if len(table) != len(want) {
+		t.Fatalf("mounts %+v, want %+v", table, want)
+	}
+	for i := range want {
+		if table[i] != want[i] {
+			t.Errorf("mount %d %+v, want %+v", i, table[i], want[i])
+		}
+	}
+
+	if _, err = readMountInfo(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("read a missing mountinfo")
+	}
+}
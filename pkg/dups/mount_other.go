@@ -0,0 +1,17 @@
+//go:build !linux
+
+package dups
+
+// mount is a mounted filesystem
+type mount struct {
+	id     int
+	device string
+	root   string
+	point  string
+}
+
+// mountOf is only implemented on linux, elsewhere files are compared by
+// device alone
+func mountOf(path string) *mount {
+	return nil
+}
@@ -0,0 +1,117 @@
+package dups
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The operations of a plan Action
+const (
+	OpHardlink = "hardlink"
+	OpSymlink  = "symlink"
+	OpReflink  = "reflink"
+	// OpTrash deletes Path, by moving it to a Trash, as Target is kept
+	OpTrash = "trash"
+)
+
+// Action is a single change proposed by a Plan: replacing Path with a link
+// to Target, or trashing it, as both had the content Hash when planned
+type Action struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// Plan is the list of actions a Scanner would have taken, to be reviewed and
+// applied later
+type Plan struct {
+	Created time.Time `json:"created"`
+	Savings int64     `json:"savings"`
+	Actions []Action  `json:"actions"`
+}
+
+// NewPlan returns an empty Plan
+func NewPlan() *Plan {
+	return &Plan{Created: time.Now()}
+}
+
+// ReadPlan reads a JSON plan, as written by WritePlan
+func ReadPlan(r io.Reader) (*Plan, error) {
+	p := &Plan{}
+	if err := json.NewDecoder(r).Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WritePlan writes p as JSON
+func WritePlan(w io.Writer, p *Plan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// ChangedError reports a file whose content no longer matches its plan, or
+// its record
+type ChangedError struct {
+	Path string
+	Want string
+	Got  string
+}
+
+func (e *ChangedError) Error() string {
+	return fmt.Sprintf("%s changed: %s, now %s", e.Path, e.Want, e.Got)
+}
+
+// Apply performs a, once both of its files are checked to still have the
+// content of the plan. A *ChangedError is returned for a file that changed,
+// and a *SkipError for a pair no longer eligible for linking. Trash actions
+// need the Trash of l, and are recorded with its Recorder.
+func (l *Linker) Apply(a Action) error {
+	if a.Op == OpTrash && l.Trash == nil {
+		return fmt.Errorf("no trash to move %s to", a.Path)
+	}
+	alg, _ := SplitDigest(a.Hash)
+	if !alg.CollisionResistant() && a.Op != OpReflink {
+		// reflinks are safe, as the kernel compares the content first
+		return &SkipError{Reason: fmt.Sprintf("%s hashes are not collision resistant, so the content may differ", alg)}
+	}
+	for _, path := range []string{a.Target, a.Path} {
+		sum, err := hashFile(path, alg)
+		if err != nil {
+			return err
+		}
+		if sum != a.Hash {
+			return &ChangedError{Path: path, Want: a.Hash, Got: sum}
+		}
+	}
+
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+	switch a.Op {
+	case OpHardlink:
+		err = l.Hardlink(a.Target, a.Path, info)
+	case OpSymlink:
+		err = l.Symlink(a.Target, a.Path)
+	case OpReflink:
+		err = l.ReflinkFile(a.Target, a.Path)
+	case OpTrash:
+		// restored from the records of the trash rather than undone
+		_, err = l.Trash.Put(TrashedFile{Path: a.Path, Target: a.Target, Hash: a.Hash, Size: info.Size()}, l.Recorder)
+		return err
+	default:
+		return fmt.Errorf("unknown plan operation %q", a.Op)
+	}
+	if err != nil {
+		return err
+	}
+	return l.journal(a.Op, a.Target, a.Path, a.Hash, info)
+}
@@ -0,0 +1,135 @@
+package dups
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// planScan plans the actions of l for a tree of a file and two duplicates,
+// and returns the root and the plan, read back from its JSON
+func planScan(t *testing.T, l *Linker) (string, *Plan) {
+	t.Helper()
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content", "b": "content", "c": "content", "d": "other"})
+	s := newTestScanner(NewMapStore())
+	s.Linker = l
+	s.Plan = NewPlan()
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, s.Plan); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Actions) != 2 || p.Savings != 2*int64(len("content")) {
+		t.Fatalf("plan of %d actions saving %d, want 2 and %d", len(p.Actions), p.Savings, 2*len("content"))
+	}
+	return root, p
+}
+
+func TestPlanApply(t *testing.T) {
+	root, p := planScan(t, &Linker{Hard: true})
+	a := filepath.Join(root, "a")
+	ai, _ := os.Stat(a)
+	for _, action := range p.Actions {
+		if action.Op != OpHardlink || action.Target != a {
+			t.Errorf("action %+v, want a hardlink to a", action)
+		}
+		// planning made no links
+		if info, _ := os.Stat(action.Path); os.SameFile(ai, info) {
+			t.Errorf("%s was linked by planning", action.Path)
+		}
+	}
+	l := &Linker{Hard: true}
+	for _, action := range p.Actions {
+		if err := l.Apply(action); err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := os.Stat(action.Path); !os.SameFile(ai, info) {
+			t.Errorf("%s is not a hardlink of a once applied", action.Path)
+		}
+	}
+}
+
+func TestApplyChanged(t *testing.T) {
+	root, p := planScan(t, &Linker{Hard: true})
+	// the duplicate of the first action, and the file kept by the second
+	path, target := p.Actions[0].Path, p.Actions[1].Target
+	writeFiles(t, root, map[string]string{filepath.Base(path): "changed"})
+	l := &Linker{Hard: true}
+	err := l.Apply(p.Actions[0])
+	if changed, ok := err.(*ChangedError); !ok || changed.Path != path {
+		t.Errorf("Apply of a changed file: %v, want a ChangedError of %s", err, path)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "changed" {
+		t.Errorf("the changed file was replaced by %q", content)
+	}
+
+	writeFiles(t, root, map[string]string{filepath.Base(target): "changed too"})
+	err = l.Apply(p.Actions[1])
+	if changed, ok := err.(*ChangedError); !ok || changed.Path != target {
+		t.Errorf("Apply to a changed target: %v, want a ChangedError of %s", err, target)
+	}
+	pi, _ := os.Stat(p.Actions[1].Path)
+	ti, _ := os.Stat(target)
+	if os.SameFile(pi, ti) {
+		t.Errorf("%s was linked to the changed target", p.Actions[1].Path)
+	}
+}
+
+func TestPlanTrash(t *testing.T) {
+	trash, err := NewTrash(filepath.Join(t.TempDir(), "trash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, p := planScan(t, &Linker{Trash: trash})
+	for _, action := range p.Actions {
+		if action.Op != OpTrash {
+			t.Errorf("action %+v, want trash", action)
+		}
+		if _, err := os.Stat(action.Path); err != nil {
+			t.Errorf("%s was trashed by planning: %v", action.Path, err)
+		}
+	}
+
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	l := &Linker{Trash: trash, Recorder: db}
+	if err = l.Apply(Action{Op: OpTrash, Path: p.Actions[0].Path}); err == nil {
+		t.Error("applied a trash action without the hash of the file")
+	}
+	// the second file changed since planned, and is kept
+	changed := p.Actions[1].Path
+	writeFiles(t, root, map[string]string{filepath.Base(changed): "changed"})
+	if err = l.Apply(p.Actions[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Apply(p.Actions[1]).(*ChangedError); !ok {
+		t.Error("trashed a file changed since planned")
+	}
+	if _, err = os.Stat(p.Actions[0].Path); !os.IsNotExist(err) {
+		t.Errorf("%s is still in place: %v", p.Actions[0].Path, err)
+	}
+	if _, err = os.Stat(changed); err != nil {
+		t.Errorf("the changed file was trashed: %v", err)
+	}
+	files, err := db.Trashed(trash.Run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != p.Actions[0].Path {
+		t.Fatalf("trash records %+v, want %s", files, p.Actions[0].Path)
+	}
+	if err = files[0].Restore(); err != nil {
+		t.Errorf("restoring the file trashed by the plan: %v", err)
+	}
+}
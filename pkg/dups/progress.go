@@ -0,0 +1,109 @@
+package dups
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress line is updated
+const progressInterval = 500 * time.Millisecond
+
+// progress updates the status line of a Scan, until it finishes
+type progress struct {
+	s     *Scanner
+	w     io.Writer
+	start time.Time
+	// base is the Stats of s when the scan started
+	base Stats
+	// files and bytes are counted ahead of the scan
+	files, bytes int64
+	width        int
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// startProgress counts the files under root, and starts updating the
+// progress line of their scan. It returns nil when s.Progress is not set.
+func (s *Scanner) startProgress(ctx context.Context, root string) *progress {
+	if s.Progress == nil {
+		return nil
+	}
+	p := &progress{s: s, w: s.Progress, stop: make(chan struct{})}
+	fmt.Fprintf(p.w, "Counting files in %s...", root)
+	s.walkFiltered(ctx, root, func(path string, info os.FileInfo) {
+		p.files++
+		p.bytes += info.Size()
+	}, nil, nil)
+	p.width = len("Counting files in ...") + len(root)
+	p.start = time.Now()
+	p.base = s.Stats()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.update()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// update rewrites the progress line
+func (p *progress) update() {
+	st := p.s.Stats()
+	files := st.FilesScanned - p.base.FilesScanned
+	bytes := st.BytesScanned - p.base.BytesScanned
+	elapsed := time.Since(p.start)
+	rate := float64(st.BytesHashed-p.base.BytesHashed) / elapsed.Seconds()
+
+	eta := "?"
+	if bytes > 0 && p.bytes >= bytes {
+		remaining := time.Duration(float64(elapsed) * float64(p.bytes-bytes) / float64(bytes))
+		eta = remaining.Round(time.Second).String()
+	}
+	line := fmt.Sprintf("%d/%d files, %s/%s, hashing %s/s, ETA %s",
+		files, p.files, formatBytes(bytes), formatBytes(p.bytes), formatBytes(int64(rate)), eta)
+	pad := ""
+	if len(line) < p.width {
+		pad = strings.Repeat(" ", p.width-len(line))
+	}
+	p.width = len(line)
+	fmt.Fprintf(p.w, "\r%s%s", line, pad)
+}
+
+// finish stops updating the progress line, once it is complete
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.update()
+	fmt.Fprintln(p.w)
+}
+
+// formatBytes formats n bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,78 @@
+package dups
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dedupeChunk is the length asked of each FIDEDUPERANGE call. Filesystems cap
+// it (btrfs at 16MiB), and report how much was actually deduplicated.
+const dedupeChunk = 16 << 20
+
+// reflink makes path share the extents of target with the FIDEDUPERANGE
+// ioctl, which has the kernel confirm that their content is identical
+func reflink(target, path string) error {
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the destination only needs to be writable for older kernels
+	dst, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrPermission) {
+		dst, err = os.Open(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	for off := uint64(0); off < size; {
+		length := size - off
+		if length > dedupeChunk {
+			length = dedupeChunk
+		}
+		r := unix.FileDedupeRange{
+			Src_offset: off,
+			Src_length: length,
+			Info: []unix.FileDedupeRangeInfo{
+				{Dest_fd: int64(dst.Fd()), Dest_offset: off},
+			},
+		}
+		if err = unix.IoctlFileDedupeRange(int(src.Fd()), &r); err != nil {
+			return reflinkError(path, err)
+		}
+		switch status := r.Info[0].Status; {
+		case status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return fmt.Errorf("content of %s differs from %s at offset %d", path, target, off)
+		case status < 0:
+			return reflinkError(path, syscall.Errno(-status))
+		}
+		if r.Info[0].Bytes_deduped == 0 {
+			return fmt.Errorf("no progress deduplicating %s at offset %d", path, off)
+		}
+		off += r.Info[0].Bytes_deduped
+	}
+	return nil
+}
+
+// reflinkError turns the errors of a filesystem without reflink support into
+// a *SkipError
+func reflinkError(path string, err error) error {
+	for _, errno := range []syscall.Errno{unix.EOPNOTSUPP, unix.EINVAL, unix.ENOTTY, unix.EXDEV, unix.ENOSYS} {
+		if errors.Is(err, errno) {
+			return &SkipError{Reason: fmt.Sprintf("filesystem of %s does not support reflinks (%v)", path, err)}
+		}
+	}
+	return err
+}
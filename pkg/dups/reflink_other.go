@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dups
+
+import "fmt"
+
+// reflink is only implemented on linux
+func reflink(target, path string) error {
+	return &SkipError{Reason: fmt.Sprintf("reflinks are not supported on this platform, leaving %s", path)}
+}
@@ -0,0 +1,1414 @@
+package dups
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Scanner walks directory trees, hashing every regular file and reporting
+// (and optionally linking) the files whose content was already seen
+type Scanner struct {
+	// Store, if set, is used to skip hashing files already recorded and to
+	// record the files hashed
+	Store Store
+	// Linker, if set, replaces duplicates with links
+	Linker *Linker
+	// Filter, if set, selects the files that are scanned
+	Filter *Filter
+	// Keep chooses the file of each group of duplicates that the others are
+	// linked to. When nil, the file kept by an earlier scan of the Scanner
+	// is, or else the first by path.
+	Keep *Keep
+	// Plan, if set, receives the actions of the Linker instead of them being
+	// taken
+	Plan *Plan
+	// Workers is the number of files hashed concurrently
+	Workers int
+	// BatchSize is the number of records written to a BatchStore at once. It
+	// defaults to DefaultBatchSize.
+	BatchSize int
+	// Algorithm is the hash used for the content of files. Records of the
+	// Store made with another algorithm are not reused.
+	Algorithm Algorithm
+	// Quiet suppresses the report of each duplicate
+	Quiet bool
+	// Verbose reports checksums and the reasons for skipping work
+	Verbose bool
+	// Prefilter skips hashing the files whose size, or whose head and tail
+	// sample, no other file shares. Such files are not recorded in the Store.
+	Prefilter bool
+	// Archives also hashes the members of the tar, tar.gz and zip archives
+	// scanned, recording them at virtual paths like "foo.tar.gz!/dir/file"
+	// (see MemberPath). Members are reported as duplicates of files, but are
+	// never linked, nor linked to. It disables Prefilter.
+	Archives bool
+	// Images, if set, is the perceptual hash of the JPEG and PNG files
+	// scanned, for SimilarImages to group those that look alike. It disables
+	// Prefilter, as similar images rarely share their size.
+	Images ImageAlgorithm
+	// Verify rehashes the files whose record in the Store is otherwise still
+	// usable, and reports those whose content drifted from the record. It
+	// disables Prefilter.
+	Verify bool
+	// Stdout and Stderr receive the report and the errors. They default to
+	// os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Progress, if set, receives a status line of each Scan, updated in place.
+	// The files are counted ahead of the scan, to estimate its remaining time.
+	Progress io.Writer
+	// Seen, if set, is called with the entry of each file of a scan once it
+	// is hashed, or found unchanged in the Store. It is called from a single
+	// goroutine.
+	Seen func(Entry)
+
+	mu    sync.Mutex
+	found map[string][]*canonical
+	sizes map[int64]bool
+	// mismatched are the pairs of duplicates not linked for their metadata,
+	// by hash
+	mismatched map[string][]*MismatchError
+	// archived is the first archive member found of each hash
+	archived map[string]string
+	// grouped are the hashes counted in Stats.Groups
+	grouped map[string]bool
+	// unread are the files the prefilter skipped as unique, by size, to be
+	// read after all once a later scan finds a file of their size. Only
+	// scans use them, one at a time.
+	unread map[int64][]*candidate
+
+	// scanMu has one scan run at a time
+	scanMu sync.Mutex
+
+	statsMu sync.Mutex
+	stats   Stats
+	errors  []*ScanError
+	images  []ImageEntry
+}
+
+// Stats counts the work done by a Scanner
+type Stats struct {
+	// FilesSeen and BytesSeen count the regular files found by the walk
+	FilesSeen int64 `json:"files_seen"`
+	BytesSeen int64 `json:"bytes_seen"`
+	// FilesFiltered counts the files skipped by the Filter, not counting
+	// those in the directories it skipped
+	FilesFiltered int64 `json:"files_filtered"`
+	// FilesScanned and BytesScanned count the files done with, whether they
+	// were hashed or not
+	FilesScanned int64 `json:"files_scanned"`
+	BytesScanned int64 `json:"bytes_scanned"`
+	// FilesHashed and BytesHashed count the files fully read and hashed
+	FilesHashed int64 `json:"files_hashed"`
+	BytesHashed int64 `json:"bytes_hashed"`
+	// CacheHits counts the files not hashed, as their record in the Store
+	// was still usable
+	CacheHits int64 `json:"cache_hits"`
+	// FilesUniqueSize counts the files skipped for having a unique size
+	FilesUniqueSize int64 `json:"files_unique_size"`
+	// FilesUniqueSample counts the files skipped for having a unique sample
+	FilesUniqueSample int64 `json:"files_unique_sample"`
+	// BytesSampled is the amount read to sample files
+	BytesSampled int64 `json:"bytes_sampled"`
+	// BytesAvoided is the amount the prefilter did not need to read
+	BytesAvoided int64 `json:"bytes_avoided"`
+	// FilesVerified counts the unchanged files rehashed by Verify, and
+	// FilesDrifted those of them whose hash no longer matched the record
+	FilesVerified int64 `json:"files_verified"`
+	FilesDrifted  int64 `json:"files_drifted"`
+	// MembersHashed counts the archive members hashed, whose size is
+	// counted in BytesHashed
+	MembersHashed int64 `json:"members_hashed"`
+	// ImagesHashed counts the images given a perceptual hash, not counting
+	// those whose record in the Store was still usable
+	ImagesHashed int64 `json:"images_hashed"`
+	// Groups counts the groups of duplicates found, each once across the
+	// scans of a Scanner, in the scan that first found it
+	Groups int64 `json:"groups"`
+	// BytesReclaimable is the size of the duplicates, and BytesReclaimed that
+	// of the ones replaced by links
+	BytesReclaimable int64 `json:"bytes_reclaimable"`
+	BytesReclaimed   int64 `json:"bytes_reclaimed"`
+	// Errors counts the errors by type
+	Errors map[string]int64 `json:"errors"`
+}
+
+// DefaultBatchSize is the number of records written to a BatchStore at once,
+// when the Scanner does not set it
+const DefaultBatchSize = 500
+
+// NewScanner returns a Scanner using store, which may be nil
+func NewScanner(store Store) *Scanner {
+	return &Scanner{
+		Store:      store,
+		Workers:    runtime.NumCPU(),
+		Algorithm:  DefaultAlgorithm,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		found:      map[string][]*canonical{},
+		sizes:      map[int64]bool{},
+		mismatched: map[string][]*MismatchError{},
+		archived:   map[string]string{},
+		grouped:    map[string]bool{},
+		unread:     map[int64][]*candidate{},
+	}
+}
+
+// canonical is a file kept by a scan, that the duplicates of its content are
+// linked to. When linking needs both files on the same filesystem, each
+// filesystem gets its own canonical file.
+type canonical struct {
+	path string
+	fs   string
+	// seed is the loaded record of the file, until it is checked to still
+	// describe it
+	seed *Entry
+	// fixed is set when the seed was too old a record to replace the file by
+	// a link
+	fixed bool
+	// loaded is set for the files of loaded records, which are not preferred
+	// over the files of the run, for the choice to not depend on the order
+	// they were recorded in
+	loaded bool
+}
+
+// Load seeds the known content with the entries of st, the path of each hash
+// on each device that s.Keep prefers. Files found later with the same hash
+// are duplicates of these entries, as long as the entry still describes its
+// file, unless s.Keep prefers them.
+func (s *Scanner) Load(st Store) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := map[string]*canonical{}
+	return st.Each(func(e Entry) error {
+		if IsArchiveMember(e.Path) {
+			// members are not kept, for files to be linked to
+			return nil
+		}
+		key := e.Hash + " " + e.DeviceID
+		if t, ok := devices[key]; !ok {
+			t = &canonical{path: e.Path, seed: &e, loaded: true}
+			devices[key] = t
+			s.found[e.Hash] = append(s.found[e.Hash], t)
+		} else if s.Keep.less(seedMember(&e), seedMember(t.seed)) {
+			t.path, t.seed = e.Path, &e
+		}
+		if e.Size >= 0 {
+			s.sizes[e.Size] = true
+		}
+		return nil
+	})
+}
+
+// Found returns the hash to path map of the content seen so far. Where there
+// is a file of the content on several filesystems, the first one is returned.
+func (s *Scanner) Found() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]string, len(s.found))
+	for hash, targets := range s.found {
+		if len(targets) > 0 {
+			m[hash] = targets[0].path
+		}
+	}
+	return m
+}
+
+// Scan walks root, and returns the number of bytes that the duplicates found
+// in it take up
+func (s *Scanner) Scan(root string) (int64, error) {
+	st, err := s.ScanContext(context.Background(), root)
+	return st.BytesReclaimable, err
+}
+
+// ScanContext walks root, until ctx is done, and returns the Stats of the
+// scan of root alone. Files are deduped against those of the earlier scans of
+// s too, so the duplicates of a root are those of content first found in it
+// or in an earlier root. Scans of a Scanner run one at a time.
+//
+// A scan is a pipeline: the walk of root feeds the files to a pool of
+// Workers, which look them up in the Store or hash them, and a single
+// aggregator collects their hashes. Once the walk is done, the aggregator
+// dedupes the files found, and sends their records to the Store writer. When
+// ctx is done, the files already hashed are recorded but not deduped, and
+// ctx.Err() is returned.
+func (s *Scanner) ScanContext(ctx context.Context, root string) (Stats, error) {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	before := s.Stats()
+	p := s.startProgress(ctx, root)
+	var err error
+	if s.Prefilter && !s.Verify && s.Images == "" && !s.Archives {
+		err = s.scanPrefiltered(ctx, root)
+	} else {
+		err = s.scan(ctx, root)
+	}
+	p.finish()
+	return s.Stats().Sub(before), err
+}
+
+// scan is ScanContext without the prefilter
+func (s *Scanner) scan(ctx context.Context, root string) error {
+	r := s.newRun(ctx)
+	err := s.walk(ctx, root, func(path string, info os.FileInfo) {
+		r.spawn(func() { r.scanFile(path, info) })
+	})
+	return r.finish(err)
+}
+
+// scanFile looks the file at path up in the Store, or hashes it, and its
+// archive members
+func (r *scanRun) scanFile(path string, info os.FileInfo) {
+	s := r.s
+	// Get the absolute filename
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		s.fail("read", path, err)
+		s.scanned(info)
+		return
+	}
+	if done, prev := r.cached(absPath, info); !done {
+		r.hash(path, absPath, info, prev)
+	}
+	if s.Archives && isArchive(absPath) {
+		r.archive(absPath, info)
+	}
+}
+
+// walk calls fn for each regular file under root that s.Filter selects, until
+// ctx is done
+func (s *Scanner) walk(ctx context.Context, root string, fn func(path string, info os.FileInfo)) error {
+	return s.walkFiltered(ctx, root, func(path string, info os.FileInfo) {
+		s.count(func(st *Stats) {
+			st.FilesSeen++
+			st.BytesSeen += info.Size()
+		})
+		fn(path, info)
+	}, func() {
+		s.count(func(st *Stats) { st.FilesFiltered++ })
+	}, func(path string, err error) {
+		s.fail("walk", path, err)
+	})
+}
+
+// walkFiltered calls fn for each regular file under root that s.Filter
+// selects, filtered, if set, for each it skips, and failed, if set, for the
+// paths that could not be read, until ctx is done
+func (s *Scanner) walkFiltered(ctx context.Context, root string, fn func(path string, info os.FileInfo), filtered func(), failed func(path string, err error)) error {
+	fw := s.Filter.walk(root)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// an unreadable directory has been visited already, and is
+			// skipped, as is a path that could not be stat'd
+			if failed != nil {
+				failed(path, err)
+			}
+			return nil
+		}
+		if info.IsDir() && s.Linker != nil && s.Linker.Trash != nil && s.Linker.Trash.contains(path) {
+			// the files already in the trash are not scanned
+			return filepath.SkipDir
+		}
+		if fw.skip(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			if filtered != nil {
+				filtered()
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		fn(path, info)
+		return nil
+	})
+}
+
+// scanPrefiltered walks root like Scan, but only reads the files that could
+// have duplicates: those sharing their size with another file, and then only
+// those whose head and tail sample matches another file of that size.
+func (s *Scanner) scanPrefiltered(ctx context.Context, root string) error {
+	var (
+		r      = s.newRun(ctx)
+		mu     sync.Mutex
+		bySize = map[int64][]*candidate{}
+	)
+	err := s.walk(ctx, root, func(path string, info os.FileInfo) {
+		r.spawn(func() {
+			absPath, err := filepath.Abs(path)
+			if err != nil {
+				s.fail("read", path, err)
+				s.scanned(info)
+				return
+			}
+			if done, _ := r.cached(absPath, info); done {
+				return
+			}
+			mu.Lock()
+			bySize[info.Size()] = append(bySize[info.Size()], &candidate{path: path, absPath: absPath, info: info})
+			mu.Unlock()
+		})
+	})
+	r.wait()
+
+	// The files of earlier scans skipped as unique are not, if this scan
+	// found others of their size
+	for size := range bySize {
+		for _, c := range s.unread[size] {
+			info, err := os.Stat(c.absPath)
+			if err != nil || info.Size() != size {
+				// left to a scan of its own
+				continue
+			}
+			avoided := size
+			s.count(func(st *Stats) {
+				if c.sample == "" {
+					st.FilesUniqueSize--
+				} else {
+					st.FilesUniqueSample--
+					avoided -= 2 * sampleSize
+				}
+				st.BytesAvoided -= avoided
+				st.FilesScanned--
+				st.BytesScanned -= size
+			})
+			c.info = info
+			bySize[size] = append(bySize[size], c)
+		}
+		delete(s.unread, size)
+	}
+
+	// Files of a size seen only once, and not recorded before, are unique
+	sizes := make([]int64, 0, len(bySize))
+	for size, files := range bySize {
+		sort.Slice(files, func(i, j int) bool { return files[i].absPath < files[j].absPath })
+		if len(files) == 1 && !s.knownSize(size) {
+			s.count(func(st *Stats) {
+				st.FilesUniqueSize++
+				st.BytesAvoided += size
+				st.FilesScanned++
+				st.BytesScanned += size
+			})
+			s.unread[size] = files
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	// Sample the files large enough for it to save reading. Recorded
+	// entries only carry a full hash, so sizes already known are not sampled.
+	sampled := map[int64]bool{}
+	for _, size := range sizes {
+		if size <= 2*sampleSize || s.knownSize(size) {
+			continue
+		}
+		sampled[size] = true
+		for _, c := range bySize[size] {
+			c := c
+			if c.sample != "" {
+				// sampled by an earlier scan
+				continue
+			}
+			r.spawn(func() {
+				sample, err := hashSample(c.path, c.info.Size())
+				if err != nil {
+					if ctx.Err() == nil {
+						s.fail("read", c.path, err)
+					}
+					return
+				}
+				s.count(func(st *Stats) { st.BytesSampled += 2 * sampleSize })
+				c.sample = sample
+			})
+		}
+	}
+	r.wait()
+
+	for _, size := range sizes {
+		bySample := map[string]int{}
+		for _, c := range bySize[size] {
+			bySample[c.sample]++
+		}
+		for _, c := range bySize[size] {
+			c := c
+			if sampled[size] && c.sample != "" && bySample[c.sample] == 1 {
+				s.count(func(st *Stats) {
+					st.FilesUniqueSample++
+					st.BytesAvoided += size - 2*sampleSize
+					st.FilesScanned++
+					st.BytesScanned += size
+				})
+				s.unread[size] = append(s.unread[size], c)
+				continue
+			}
+			r.spawn(func() {
+				r.hash(c.path, c.absPath, c.info, nil)
+			})
+		}
+	}
+	return r.finish(err)
+}
+
+// candidate is a file the prefilter may skip reading
+type candidate struct {
+	path, absPath string
+	info          os.FileInfo
+	sample        string
+}
+
+// scanRun is the state of a single Scan: the pool of workers hashing files,
+// the aggregator of their results, and the writer recording them to the Store
+type scanRun struct {
+	s   *Scanner
+	ctx context.Context
+
+	// jobs feed the pool of workers, and jobsWg counts the jobs not done yet
+	jobs      chan func()
+	workersWg sync.WaitGroup
+	jobsWg    sync.WaitGroup
+
+	// results feed the aggregator, and resultsWg counts the results it has
+	// not collected yet
+	results    chan result
+	resultsWg  sync.WaitGroup
+	aggregated chan struct{}
+
+	records chan storeOp
+	wgStore sync.WaitGroup
+
+	// pending are the files hashed, or found unchanged, by hash. Only the
+	// aggregator uses them.
+	pending map[string][]*member
+}
+
+// result is a file whose hash is known, sent to the aggregator
+type result struct {
+	hash string
+	m    *member
+}
+
+func (s *Scanner) newRun(ctx context.Context) *scanRun {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	r := &scanRun{
+		s:          s,
+		ctx:        ctx,
+		jobs:       make(chan func(), workers),
+		results:    make(chan result, workers*2),
+		aggregated: make(chan struct{}),
+		pending:    map[string][]*member{},
+		// Channel for sending records to the store
+		records: make(chan storeOp, workers*2),
+	}
+
+	for i := 0; i < workers; i++ {
+		r.workersWg.Add(1)
+		go func() {
+			defer r.workersWg.Done()
+			for fn := range r.jobs {
+				if ctx.Err() == nil {
+					fn()
+				}
+				r.jobsWg.Done()
+			}
+		}()
+	}
+
+	go func() {
+		defer close(r.aggregated)
+		r.aggregate()
+	}()
+
+	// Start the store writer goroutine if a Store is provided
+	if s.Store != nil {
+		r.wgStore.Add(1)
+		go func() {
+			defer r.wgStore.Done()
+			r.write()
+		}()
+	}
+	return r
+}
+
+// storeOp is a record sent to the Store: either the new Entry of a file, or
+// the path of an unchanged one to mark as checked
+type storeOp struct {
+	e     Entry
+	touch string
+}
+
+// write records the ops sent by the run, in batches if the Store supports it
+func (r *scanRun) write() {
+	s := r.s
+	batcher, ok := s.Store.(BatchStore)
+	if !ok {
+		for op := range r.records {
+			r.writeOne(op)
+		}
+		return
+	}
+	size := s.BatchSize
+	if size < 1 {
+		size = DefaultBatchSize
+	}
+	var (
+		puts    []Entry
+		touches []string
+	)
+	flush := func() {
+		if len(puts)+len(touches) == 0 {
+			return
+		}
+		if err := batcher.Batch(puts, touches); err != nil {
+			// find the records that fail, one at a time
+			for _, e := range puts {
+				r.writeOne(storeOp{e: e})
+			}
+			for _, path := range touches {
+				r.writeOne(storeOp{touch: path})
+			}
+		}
+		puts, touches = puts[:0], touches[:0]
+	}
+	for op := range r.records {
+		if op.touch != "" {
+			touches = append(touches, op.touch)
+		} else {
+			puts = append(puts, op.e)
+		}
+		if len(puts)+len(touches) >= size {
+			flush()
+		}
+	}
+	flush()
+}
+
+// writeOne records a single op
+func (r *scanRun) writeOne(op storeOp) {
+	s := r.s
+	if op.touch != "" {
+		if err := s.Store.Touch(op.touch); err != nil {
+			s.fail("store", op.touch, err)
+		}
+	} else if err := s.Store.Put(op.e); err != nil {
+		s.fail("store", op.e.Path, err)
+	}
+}
+
+// spawn queues fn for the pool of workers, unless the run is cancelled
+func (r *scanRun) spawn(fn func()) {
+	r.jobsWg.Add(1)
+	select {
+	case r.jobs <- fn:
+	case <-r.ctx.Done():
+		r.jobsWg.Done()
+	}
+}
+
+// wait for the jobs queued so far to be done, and their results collected
+func (r *scanRun) wait() {
+	r.jobsWg.Wait()
+	r.resultsWg.Wait()
+}
+
+// see sends the hash of m to the aggregator, once the perceptual hash of an
+// image is taken
+func (r *scanRun) see(hash string, m *member) {
+	if r.s.Images != "" && m.archive == nil && isImage(m.path) {
+		r.s.image(hash, m.path, m.info)
+	}
+	r.resultsWg.Add(1)
+	r.results <- result{hash: hash, m: m}
+}
+
+// aggregate collects the results of the workers, and dedupes them once there
+// are no more
+func (r *scanRun) aggregate() {
+	s := r.s
+	for res := range r.results {
+		r.pending[res.hash] = append(r.pending[res.hash], res.m)
+		if s.Seen != nil {
+			s.Seen(NewEntry(res.m.path, res.hash, res.m.info))
+		}
+		s.mu.Lock()
+		s.sizes[res.m.info.Size()] = true
+		s.mu.Unlock()
+		r.resultsWg.Done()
+	}
+	if r.ctx.Err() != nil {
+		// the run was cancelled, with its files not all known yet
+		for hash, files := range r.pending {
+			for _, m := range files {
+				if m.hashed {
+					r.record(hash, m)
+				}
+			}
+		}
+		return
+	}
+	r.resolve()
+}
+
+// finish stops the workers, has the aggregator dedupe the files found, waits
+// for the store writer, and counts the savings. It returns err, or the error
+// of the run's context.
+func (r *scanRun) finish(err error) error {
+	close(r.jobs)
+	r.workersWg.Wait()
+	close(r.results)
+	<-r.aggregated
+
+	// Close the records channel and wait for the store writer to finish
+	close(r.records)
+	r.wgStore.Wait()
+	if r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+	return err
+}
+
+// cached handles absPath from its record in the Store, if the record is still
+// usable. It returns false if the file needs to be hashed, along with the
+// record to verify the new hash against when s.Verify is set.
+func (r *scanRun) cached(absPath string, info os.FileInfo) (bool, *Entry) {
+	s := r.s
+	if s.Store == nil {
+		return false, nil
+	}
+	e, ok, err := s.Store.Get(absPath)
+	if err != nil {
+		s.fail("store", absPath, err)
+		return false, nil
+	}
+	if !ok {
+		return false, nil
+	}
+	if alg, _ := SplitDigest(e.Hash); alg != s.algorithm() {
+		if s.Verbose {
+			fmt.Fprintf(s.Stdout, "Hash algorithm changed: %s (%s -> %s)\n", absPath, alg, s.algorithm())
+		}
+		return false, nil
+	}
+	if why := e.Changed(NewEntry(absPath, e.Hash, info)); why != "" {
+		if s.Verbose {
+			fmt.Fprintf(s.Stdout, "File changed: %s (%s)\n", absPath, why)
+		}
+		return false, nil
+	}
+	if s.Verify {
+		return false, &e
+	}
+
+	// File hasn't changed, assume content is the same (skip checksum)
+	if s.Verbose {
+		fmt.Fprintf(s.Stdout, "SKIPPED checksum for %s (already in DB, unchanged)\n", absPath)
+	}
+
+	s.count(func(st *Stats) { st.CacheHits++ })
+	s.scanned(info)
+	r.see(e.Hash, &member{path: absPath, info: info, seen: true})
+	return true, nil
+}
+
+// hash calculates the hash of a new or changed file, and dedupes it. If prev
+// is set, the file is being verified against that record.
+func (r *scanRun) hash(path, absPath string, info os.FileInfo, prev *Entry) {
+	s := r.s
+	defer s.scanned(info)
+	sum, err := hashFileContext(r.ctx, path, s.algorithm())
+	if err != nil {
+		if r.ctx.Err() == nil {
+			s.fail("read", path, err)
+		}
+		return
+	}
+	s.count(func(st *Stats) {
+		st.FilesHashed++
+		st.BytesHashed += info.Size()
+	})
+
+	if s.Verbose {
+		alg, hex := SplitDigest(sum)
+		fmt.Fprintf(s.Stdout, "%s(%s)= %s\n", strings.ToUpper(string(alg)), absPath, hex)
+	}
+	if prev != nil {
+		s.count(func(st *Stats) { st.FilesVerified++ })
+		if prev.Hash != sum {
+			s.count(func(st *Stats) { st.FilesDrifted++ })
+			fmt.Fprintf(s.Stdout, "DRIFT %s: recorded %s, now %s\n", absPath, prev.Hash, sum)
+		}
+	}
+
+	r.see(sum, &member{path: absPath, info: info, seen: true, hashed: true})
+}
+
+// algorithm is the Algorithm of s, or the DefaultAlgorithm
+func (s *Scanner) algorithm() Algorithm {
+	if s.Algorithm == "" {
+		return DefaultAlgorithm
+	}
+	return s.Algorithm
+}
+
+// Rehash updates the records of the Store that were made with another
+// algorithm than that of s, for the files that still exist. It returns the
+// number of records updated.
+func (s *Scanner) Rehash() (int, error) {
+	var stale []Entry
+	err := s.Store.Each(func(e Entry) error {
+		if alg, _ := SplitDigest(e.Hash); alg != s.algorithm() {
+			stale = append(stale, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range stale {
+		info, err := os.Stat(e.Path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		sum, err := hashFile(e.Path, s.algorithm())
+		if err != nil {
+			s.fail("read", e.Path, err)
+			continue
+		}
+		if err = s.Store.Put(NewEntry(e.Path, sum, info)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Mismatched returns the pairs of duplicates that were not linked as their
+// metadata differs, by hash
+func (s *Scanner) Mismatched() map[string][]*MismatchError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string][]*MismatchError, len(s.mismatched))
+	for hash, errs := range s.mismatched {
+		m[hash] = append([]*MismatchError(nil), errs...)
+	}
+	return m
+}
+
+// knownSize reports whether content of size bytes has been seen
+func (s *Scanner) knownSize(size int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizes[size]
+}
+
+// count updates the Stats of s
+func (s *Scanner) count(fn func(*Stats)) {
+	s.statsMu.Lock()
+	fn(&s.stats)
+	s.statsMu.Unlock()
+}
+
+// scanned counts the file of info as done with
+func (s *Scanner) scanned(info os.FileInfo) {
+	s.count(func(st *Stats) {
+		st.FilesScanned++
+		st.BytesScanned += info.Size()
+	})
+}
+
+// fail reports the error of op on path, adds it to the Errors of s, and
+// records it in the Store if it keeps a log of them
+func (s *Scanner) fail(op, path string, err error) {
+	e := newScanError(op, path, err)
+	fmt.Fprintln(s.Stderr, "Error:", e)
+	s.statsMu.Lock()
+	s.errors = append(s.errors, e)
+	if s.stats.Errors == nil {
+		s.stats.Errors = map[string]int64{}
+	}
+	s.stats.Errors[e.Kind]++
+	s.statsMu.Unlock()
+
+	if recorder, ok := s.Store.(ErrorRecorder); ok {
+		if rerr := recorder.RecordError(e); rerr != nil {
+			fmt.Fprintln(s.Stderr, "Error recording error:", rerr)
+		}
+	}
+}
+
+// Errors returns the errors met by s so far
+func (s *Scanner) Errors() []*ScanError {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return append([]*ScanError(nil), s.errors...)
+}
+
+// Sub returns the counts of st since those of before
+func (st Stats) Sub(before Stats) Stats {
+	d := Stats{
+		FilesSeen:         st.FilesSeen - before.FilesSeen,
+		BytesSeen:         st.BytesSeen - before.BytesSeen,
+		FilesFiltered:     st.FilesFiltered - before.FilesFiltered,
+		FilesScanned:      st.FilesScanned - before.FilesScanned,
+		BytesScanned:      st.BytesScanned - before.BytesScanned,
+		FilesHashed:       st.FilesHashed - before.FilesHashed,
+		BytesHashed:       st.BytesHashed - before.BytesHashed,
+		CacheHits:         st.CacheHits - before.CacheHits,
+		FilesUniqueSize:   st.FilesUniqueSize - before.FilesUniqueSize,
+		FilesUniqueSample: st.FilesUniqueSample - before.FilesUniqueSample,
+		BytesSampled:      st.BytesSampled - before.BytesSampled,
+		BytesAvoided:      st.BytesAvoided - before.BytesAvoided,
+		FilesVerified:     st.FilesVerified - before.FilesVerified,
+		FilesDrifted:      st.FilesDrifted - before.FilesDrifted,
+		MembersHashed:     st.MembersHashed - before.MembersHashed,
+		ImagesHashed:      st.ImagesHashed - before.ImagesHashed,
+		Groups:            st.Groups - before.Groups,
+		BytesReclaimable:  st.BytesReclaimable - before.BytesReclaimable,
+		BytesReclaimed:    st.BytesReclaimed - before.BytesReclaimed,
+		Errors:            map[string]int64{},
+	}
+	for kind, n := range st.Errors {
+		if n -= before.Errors[kind]; n != 0 {
+			d.Errors[kind] = n
+		}
+	}
+	return d
+}
+
+// Stats returns the counters of the work done by s so far
+func (s *Scanner) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	st := s.stats
+	st.Errors = make(map[string]int64, len(s.stats.Errors))
+	for kind, n := range s.stats.Errors {
+		st.Errors[kind] = n
+	}
+	return st
+}
+
+// resolve dedupes the files found by the run, one group of the same content
+// at a time, in the order of their hash
+func (r *scanRun) resolve() {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]string, 0, len(r.pending))
+	for hash := range r.pending {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		r.dedupe(hash, r.pending[hash])
+	}
+	r.pending = nil
+}
+
+// dedupe keeps one file of the group of content hash on each filesystem, as
+// chosen by s.Keep, and reports and links the others to it. The group is the
+// files of the run, and those kept by earlier scans. s.mu must be held.
+func (r *scanRun) dedupe(hash string, files []*member) {
+	s := r.s
+	var members []*member
+	files, members = splitMembers(files)
+	defer r.members(hash, members, files)
+	for _, t := range s.targets(hash) {
+		info, err := os.Stat(t.path)
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, m := range files {
+			if m.path == t.path {
+				m.earlier, found = !t.loaded, true
+			}
+		}
+		if !found {
+			files = append(files, &member{path: t.path, info: info, earlier: !t.loaded, fixed: t.fixed})
+		}
+	}
+	for _, m := range files {
+		m.fs = s.filesystem(m.path, m.info)
+	}
+	sort.Slice(files, func(i, j int) bool { return s.Keep.less(files[i], files[j]) })
+
+	// the first file of each filesystem, in order of preference, is kept
+	var (
+		kept     []*canonical
+		keepers  = map[string]*member{}
+		linked   = map[string]bool{}
+		rejected = map[*member]bool{}
+	)
+	for _, m := range files {
+		keep, ok := keepers[m.fs]
+		if !ok {
+			keepers[m.fs] = m
+			kept = append(kept, &canonical{path: m.path, fs: m.fs, fixed: m.fixed})
+			if len(kept) > 1 && m.seen {
+				// there is no copy on this filesystem to link to
+				if !s.Quiet {
+					fmt.Fprintf(s.Stdout, "%q is the same content as %q\n", m.path, kept[0].path)
+				}
+				if s.Verbose {
+					fmt.Fprintf(s.Stdout, "Skipped link: no copy on the same filesystem as %s\n", m.path)
+				}
+			}
+			continue
+		}
+		if m.fixed {
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "Skipped link: the record of %s is too old to replace it\n", m.path)
+			}
+			continue
+		}
+		if os.SameFile(keep.info, m.info) {
+			// already a hardlink of the kept file, taking no space
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "%q is already a hardlink of %q\n", m.path, keep.path)
+			}
+			continue
+		}
+		if !s.grouped[hash] {
+			s.grouped[hash] = true
+			s.count(func(st *Stats) { st.Groups++ })
+		}
+		info, ok := r.replace(hash, keep.path, m)
+		if !ok {
+			rejected[m] = true
+			continue
+		}
+		if info != m.info {
+			linked[m.fs] = true
+			m.info = info
+			m.hashed = true
+		}
+	}
+	s.found[hash] = kept
+
+	for _, m := range files {
+		if rejected[m] {
+			continue
+		}
+		if keepers[m.fs] == m && linked[m.fs] {
+			// hardlinking changed the ctime and link count of the kept file
+			if info, err := os.Stat(m.path); err == nil {
+				m.info = info
+				m.hashed = true
+			}
+		}
+		r.record(hash, m)
+	}
+}
+
+// splitMembers splits the archive members out of files
+func splitMembers(files []*member) (regular, members []*member) {
+	for _, m := range files {
+		if m.archive != nil {
+			members = append(members, m)
+		} else {
+			regular = append(regular, m)
+		}
+	}
+	return regular, members
+}
+
+// members reports the archive members of hash that are the same content as
+// the file kept, or else as the first member found, and the files of the run
+// that are the same content as a member of an earlier run. They are recorded,
+// but never linked. s.mu must be held.
+func (r *scanRun) members(hash string, members, files []*member) {
+	s := r.s
+	sort.Slice(members, func(i, j int) bool { return members[i].path < members[j].path })
+	first, earlier := s.archived[hash]
+	if !earlier && len(members) > 0 {
+		first = members[0].path
+		s.archived[hash] = first
+	}
+	if !s.Quiet && first != "" {
+		kept := ""
+		if targets := s.found[hash]; len(targets) > 0 {
+			kept = targets[0].path
+		}
+		for _, m := range members {
+			if kept != "" {
+				fmt.Fprintf(s.Stdout, "archive member %q is the same content as %q\n", m.path, kept)
+			} else if m.path != first {
+				fmt.Fprintf(s.Stdout, "archive member %q is the same content as %q\n", m.path, first)
+			}
+		}
+		if earlier && len(members) == 0 {
+			for _, m := range files {
+				if m.seen {
+					fmt.Fprintf(s.Stdout, "%q is the same content as archive member %q\n", m.path, first)
+				}
+			}
+		}
+	}
+	for _, m := range members {
+		r.record(hash, m)
+	}
+}
+
+// replace reports m as a duplicate of target, and links it as configured. It
+// returns the stat info of m, which changes when it was hardlinked, and false
+// if linking failed. s.mu must be held.
+func (r *scanRun) replace(hash, target string, m *member) (os.FileInfo, bool) {
+	s := r.s
+	info := m.info
+	if !s.Quiet {
+		fmt.Fprintf(s.Stdout, "%q is the same content as %q\n", m.path, target)
+	}
+	if s.Linker != nil && (s.Linker.Hard || s.Linker.Symbolic) {
+		err := s.Linker.CheckMetadata(target, m.path)
+		if mismatch, ok := err.(*MismatchError); ok {
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "Skipped link: %s\n", err)
+			}
+			s.mismatched[hash] = append(s.mismatched[hash], mismatch)
+			return info, true
+		} else if err != nil {
+			s.fail("link", m.path, err)
+			return info, false
+		}
+	}
+	if s.Linker != nil && s.Plan != nil {
+		s.plan(target, m.path, hash, info)
+	} else if s.Linker != nil && s.Linker.Trash != nil {
+		if !s.trash(hash, target, m.path, info) {
+			return info, false
+		}
+		m.trashed = true
+	} else if s.Linker != nil {
+		linked, ok := s.link(hash, target, m.path, info)
+		if !ok {
+			return info, false
+		}
+		if linked {
+			if newInfo, err := os.Stat(m.path); err == nil {
+				info = newInfo
+			}
+		}
+	}
+	s.count(func(st *Stats) { st.BytesReclaimable += info.Size() })
+	return info, true
+}
+
+// record sends the new record of m to the Store, or marks its unchanged
+// record as checked
+func (r *scanRun) record(hash string, m *member) {
+	s := r.s
+	if s.Store == nil || m.trashed {
+		return
+	}
+	if m.hashed && m.archive != nil {
+		// members are recorded with the device, inode and ctime of their
+		// archive, for the record to be known stale once it changes
+		e, a := NewEntry(m.path, hash, m.info), NewEntry(m.path, hash, m.archive)
+		e.DeviceID, e.Inode, e.CTime = a.DeviceID, a.Inode, a.CTime
+		r.records <- storeOp{e: e}
+	} else if m.hashed {
+		r.records <- storeOp{e: NewEntry(m.path, hash, m.info)}
+	} else if m.seen {
+		// Update the checked_time in the store
+		r.records <- storeOp{touch: m.path}
+	}
+}
+
+// targets returns the files of hash kept by earlier scans, once the loaded
+// records among them are checked to still describe their file. s.mu must be
+// held.
+func (s *Scanner) targets(hash string) []*canonical {
+	targets := s.found[hash][:0]
+	for _, t := range s.found[hash] {
+		if t.seed != nil {
+			why := seedChanged(*t.seed)
+			if why != "" {
+				if s.Verbose {
+					fmt.Fprintf(s.Stdout, "Dropped stale record of %s (%s)\n", t.path, why)
+				}
+				continue
+			}
+			t.fixed = t.seed.Size < 0
+			t.seed = nil
+		}
+		targets = append(targets, t)
+	}
+	s.found[hash] = targets
+	return targets
+}
+
+// filesystem identifies the filesystem of path, when the Linker needs it
+func (s *Scanner) filesystem(path string, info os.FileInfo) string {
+	if s.Linker == nil || !s.Linker.SameFilesystem() {
+		return ""
+	}
+	return filesystem(path, info)
+}
+
+// seedChanged describes how the file of a loaded record changed since, or
+// returns "" if it did not. Records without a known size only need the file
+// to still exist.
+func seedChanged(seed Entry) string {
+	info, err := os.Stat(seed.Path)
+	if err != nil {
+		return err.Error()
+	}
+	if !info.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if seed.Size < 0 {
+		return ""
+	}
+	return seed.Changed(NewEntry(seed.Path, seed.Hash, info))
+}
+
+// plan adds the actions of the Linker for path to s.Plan. s.mu must be held.
+func (s *Scanner) plan(target, path, hash string, info os.FileInfo) {
+	a := Action{
+		Path:   path,
+		Target: target,
+		Hash:   hash,
+		Size:   info.Size(),
+		Reason: fmt.Sprintf("same content as %s", target),
+	}
+	planned := false
+	if s.Linker.Hard {
+		if err := s.Linker.CheckHardlink(target, path, info); err != nil {
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "Skipped hardlink: %s\n", err)
+			}
+		} else {
+			a.Op = OpHardlink
+			s.Plan.Actions = append(s.Plan.Actions, a)
+			planned = true
+		}
+	}
+	if s.Linker.Symbolic {
+		a.Op = OpSymlink
+		s.Plan.Actions = append(s.Plan.Actions, a)
+		planned = true
+	}
+	if s.Linker.Reflink {
+		a.Op = OpReflink
+		s.Plan.Actions = append(s.Plan.Actions, a)
+		planned = true
+	}
+	if s.Linker.Trash != nil {
+		a.Op = OpTrash
+		s.Plan.Actions = append(s.Plan.Actions, a)
+		planned = true
+	}
+	if planned {
+		s.Plan.Savings += info.Size()
+	}
+}
+
+// link replaces path with links to target, as configured on the Linker. It
+// returns whether path was hardlinked, and false if linking failed.
+func (s *Scanner) link(hash, target, path string, info os.FileInfo) (bool, bool) {
+	hardlinked, reclaimed := false, false
+	defer func() {
+		if reclaimed {
+			s.count(func(st *Stats) { st.BytesReclaimed += info.Size() })
+		}
+	}()
+	if s.Linker.Hard {
+		err := s.Linker.Hardlink(target, path, info)
+		if _, skipped := err.(*SkipError); skipped {
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "Skipped hardlink: %s\n", err)
+			}
+		} else if err != nil {
+			s.fail("link", path, err)
+			return false, false
+		} else {
+			hardlinked, reclaimed = true, true
+			fmt.Fprintf(s.Stdout, "hard linked %q to %q\n", path, target)
+			s.journal(OpHardlink, hash, target, path, info)
+		}
+	}
+	if s.Linker.Symbolic {
+		if err := s.Linker.Symlink(target, path); err != nil {
+			s.fail("link", path, err)
+			return false, false
+		}
+		reclaimed = true
+		fmt.Fprintf(s.Stdout, "soft linked %q to %q\n", path, target)
+		s.journal(OpSymlink, hash, target, path, info)
+	}
+	if s.Linker.Reflink {
+		err := s.Linker.ReflinkFile(target, path)
+		if _, skipped := err.(*SkipError); skipped {
+			// not verbose only, as this is the filesystem falling short
+			fmt.Fprintf(s.Stderr, "Skipped reflink: %s\n", err)
+		} else if err != nil {
+			s.fail("link", path, err)
+			return false, false
+		} else {
+			reclaimed = true
+			fmt.Fprintf(s.Stdout, "reflinked %q to %q\n", path, target)
+			s.journal(OpReflink, hash, target, path, info)
+		}
+	}
+	return hardlinked, true
+}
+
+// journal records the link of path to target in the Journal of the Linker,
+// with info the stat info of path before
+func (s *Scanner) journal(op, hash, target, path string, info os.FileInfo) {
+	if err := s.Linker.journal(op, target, path, hash, info); err != nil {
+		s.fail("store", path, err)
+	}
+}
+
+// image takes the perceptual hash of the image at path, unless its record in
+// the Store is still usable, and keeps it for SimilarImages
+func (s *Scanner) image(digest, path string, info os.FileInfo) {
+	cur := newImageEntry(path, s.Images, 0, info)
+	store, _ := s.Store.(ImageStore)
+	e, ok := ImageEntry{}, false
+	if store != nil {
+		var err error
+		if e, ok, err = store.GetImage(path, s.Images); err != nil {
+			s.fail("store", path, err)
+		}
+		ok = ok && e.Size == cur.Size && e.ModTime.Equal(cur.ModTime) && e.CTime.Equal(cur.CTime)
+	}
+	if !ok {
+		hash, err := ImageHashFile(path, s.Images)
+		if err != nil {
+			// not an image after all, or one that can not be decoded
+			if s.Verbose {
+				fmt.Fprintf(s.Stdout, "Skipped image hash of %s: %s\n", path, err)
+			}
+			return
+		}
+		e = cur
+		e.Hash = hash
+		s.count(func(st *Stats) { st.ImagesHashed++ })
+		if store != nil {
+			if err := store.PutImage(e); err != nil {
+				s.fail("store", path, err)
+			}
+		}
+	}
+	e.Digest = digest
+	s.statsMu.Lock()
+	s.images = append(s.images, e)
+	s.statsMu.Unlock()
+}
+
+// SimilarImages groups the images of the scans of s whose perceptual hashes
+// are within maxDistance bits, leaving out the groups of byte-exact
+// duplicates. Similar images are only reported, never linked.
+func (s *Scanner) SimilarImages(maxDistance int) []SimilarGroup {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	// the latest entry of each path, as a path may be scanned again
+	latest := map[string]int{}
+	for i, e := range s.images {
+		latest[e.Path] = i
+	}
+	images := make([]ImageEntry, 0, len(latest))
+	for i, e := range s.images {
+		if latest[e.Path] == i {
+			images = append(images, e)
+		}
+	}
+	return GroupSimilar(images, maxDistance)
+}
+
+// trash moves path to the Trash of the Linker, and records the move when the
+// Store is a TrashRecorder. It returns false if moving or recording failed,
+// which leaves the file in place.
+func (s *Scanner) trash(hash, target, path string, info os.FileInfo) bool {
+	rec, _ := s.Store.(TrashRecorder)
+	f, err := s.Linker.Trash.Put(TrashedFile{Path: path, Target: target, Hash: hash, Size: info.Size()}, rec)
+	if err != nil {
+		s.fail("link", path, err)
+		return false
+	}
+	s.count(func(st *Stats) { st.BytesReclaimed += info.Size() })
+	fmt.Fprintf(s.Stdout, "trashed %q to %q\n", path, f.TrashPath)
+	return true
+}
+
+// sampleSize is the number of bytes read from each of the head and the tail of
+// a file to sample it
+const sampleSize = 4096
+
+// hashSample returns the digest of the head and tail of path, which is size
+// bytes long. Samples are only compared among themselves, so the fast XXHash
+// is used.
+func hashSample(path string, size int64) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := xxhash.New()
+	if _, err = io.Copy(h, io.NewSectionReader(fh, 0, sampleSize)); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(h, io.NewSectionReader(fh, size-sampleSize, sampleSize)); err != nil {
+		return "", err
+	}
+	return XXHash.Digest(h.Sum(nil)), nil
+}
+
+// hashFile returns the digest of the content of path
+func hashFile(path string, alg Algorithm) (string, error) {
+	return hashFileContext(context.Background(), path, alg)
+}
+
+// hashFileContext returns the digest of the content of path, unless ctx is
+// done before it is all read
+func hashFileContext(ctx context.Context, path string, alg Algorithm) (string, error) {
+	h, err := alg.New()
+	if err != nil {
+		return "", err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	if _, err = io.Copy(h, contextReader{ctx, fh}); err != nil {
+		return "", err
+	}
+	return alg.Digest(h.Sum(nil)), nil
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
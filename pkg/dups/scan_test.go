@@ -0,0 +1,386 @@
+package dups
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the files of the contents by path relative to root
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestScanner returns a Scanner of store reporting nothing
+func newTestScanner(store Store) *Scanner {
+	s := NewScanner(store)
+	s.Stdout, s.Stderr = io.Discard, io.Discard
+	return s
+}
+
+// groupPaths returns the paths of the files of each duplicate group of st,
+// sorted
+func groupPaths(t testing.TB, st Store) [][]string {
+	t.Helper()
+	groups, err := DuplicateGroups(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths [][]string
+	for _, g := range groups {
+		var files []string
+		for _, e := range g.Files {
+			files = append(files, e.Path)
+		}
+		sort.Strings(files)
+		paths = append(paths, files)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i][0] < paths[j][0] })
+	return paths
+}
+
+func TestScanGroups(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a":       "same content",
+		"sub/b":   "same content",
+		"sub/c/d": "same content",
+		"e":       "other content",
+		"f":       "unique",
+		"g":       "other content",
+	})
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Workers = 4
+	reclaimable, err := s.Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(2*len("same content") + len("other content")); reclaimable != want {
+		t.Errorf("reclaimable %d bytes, want %d", reclaimable, want)
+	}
+	got := groupPaths(t, store)
+	want := [][]string{
+		{filepath.Join(root, "a"), filepath.Join(root, "sub/b"), filepath.Join(root, "sub/c/d")},
+		{filepath.Join(root, "e"), filepath.Join(root, "g")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("groups %q, want %q", got, want)
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("groups %q, want %q", got, want)
+		}
+		for j := range want[i] {
+			if got[i][j] != want[i][j] {
+				t.Errorf("groups %q, want %q", got, want)
+			}
+		}
+	}
+	if st := s.Stats(); st.FilesHashed != 6 || st.Groups != 2 {
+		t.Errorf("hashed %d files in %d groups, want 6 in 2", st.FilesHashed, st.Groups)
+	}
+}
+
+func TestScanCached(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "x", "b": "x", "c": "y"})
+	store := NewMapStore()
+	if _, err := newTestScanner(store).Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestScanner(store)
+	if err := s.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.CacheHits != 3 || st.FilesHashed != 0 {
+		t.Errorf("rescan had %d cache hits and hashed %d files, want 3 and 0", st.CacheHits, st.FilesHashed)
+	}
+
+	// a changed file is hashed again
+	writeFiles(t, root, map[string]string{"c": "changed"})
+	s = newTestScanner(store)
+	if _, err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.FilesHashed != 1 {
+		t.Errorf("hashed %d files after a change, want 1", st.FilesHashed)
+	}
+	e, ok, err := store.Get(filepath.Join(root, "c"))
+	if err != nil || !ok {
+		t.Fatalf("no record of the changed file: %v", err)
+	}
+	if e.Size != int64(len("changed")) {
+		t.Errorf("record of size %d, want %d", e.Size, len("changed"))
+	}
+}
+
+func TestScanKeptStable(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFiles(t, root, map[string]string{"a/1": "same", "a/2": "same", "b/1": "same", "b/2": "same"})
+			// the files of b are recorded before those of a
+			if _, err := newTestScanner(store).Scan(filepath.Join(root, "b")); err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join(root, "a", "1")
+			for run := 1; run <= 4; run++ {
+				if run == 3 {
+					// the record of the kept file is rewritten
+					later := time.Now().Add(time.Hour)
+					if err := os.Chtimes(want, later, later); err != nil {
+						t.Fatal(err)
+					}
+				}
+				s := newTestScanner(store)
+				if err := s.Load(store); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := s.Scan(root); err != nil {
+					t.Fatal(err)
+				}
+				for _, kept := range s.Found() {
+					if kept != want {
+						t.Errorf("run %d kept %s, want %s", run, kept, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScanChangedInPlace(t *testing.T) {
+	for _, replace := range []bool{false, true} {
+		root := t.TempDir()
+		writeFiles(t, root, map[string]string{"a": "before"})
+		path := filepath.Join(root, "a")
+		store := NewMapStore()
+		if _, err := newTestScanner(store).Scan(root); err != nil {
+			t.Fatal(err)
+		}
+		before, _, _ := store.Get(path)
+
+		// the same size and mtime, as an editor or a copy keeping the
+		// times would leave it, but not the same ctime, or inode
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if replace {
+			writeFiles(t, root, map[string]string{"b": "after!"})
+			err = os.Rename(filepath.Join(root, "b"), path)
+		} else {
+			err = os.WriteFile(path, []byte("after!"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newTestScanner(store)
+		if _, err = s.Scan(root); err != nil {
+			t.Fatal(err)
+		}
+		after, _, _ := store.Get(path)
+		if st := s.Stats(); st.FilesHashed != 1 || after.Hash == before.Hash {
+			t.Errorf("replaced %v: hashed %d files, hash %s -> %s, want the file rehashed", replace, st.FilesHashed, before.Hash, after.Hash)
+		}
+	}
+}
+
+func TestScanPrefilterAcrossRoots(t *testing.T) {
+	big := strings.Repeat("0123456789", 2*sampleSize/10+100)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		// unique in its root by size
+		"a/f": "content of f",
+		"b/g": "content of f",
+		// unique in its root by sample, among files of its size
+		"a/big1": big,
+		"a/big2": "x" + big[1:],
+		"b/big3": big,
+	})
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Prefilter = true
+	for _, dir := range []string{"a", "b"} {
+		if _, err := s.ScanContext(context.Background(), filepath.Join(root, dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := groupPaths(t, store)
+	want := [][]string{
+		{filepath.Join(root, "a/big1"), filepath.Join(root, "b/big3")},
+		{filepath.Join(root, "a/f"), filepath.Join(root, "b/g")},
+	}
+	if len(got) != len(want) || got[0][1] != want[0][1] || got[1][1] != want[1][1] {
+		t.Errorf("groups %q, want %q", got, want)
+	}
+	if st := s.Stats(); st.FilesUniqueSize != 0 || st.FilesUniqueSample != 1 || st.FilesScanned != 5 {
+		t.Errorf("%d unique by size, %d by sample, %d scanned, want 0, 1 and 5",
+			st.FilesUniqueSize, st.FilesUniqueSample, st.FilesScanned)
+	}
+}
+
+// concurrentTree writes roots of files, the first shared of each having the
+// same content in every root, and returns the roots and the size of the
+// shared files
+func concurrentTree(t *testing.T, roots, files, shared int) ([]string, int64) {
+	dir := t.TempDir()
+	var paths []string
+	size := int64(0)
+	for r := 0; r < roots; r++ {
+		root := filepath.Join(dir, fmt.Sprintf("root%d", r))
+		tree := map[string]string{}
+		for i := 0; i < files; i++ {
+			content := fmt.Sprintf("unique %d of root %d", i, r)
+			if i < shared {
+				content = strings.Repeat(fmt.Sprintf("shared %d;", i), 100+i)
+				if r == 0 {
+					size += int64(len(content))
+				}
+			}
+			tree[fmt.Sprintf("d%d/f%d", i%5, i)] = content
+		}
+		writeFiles(t, root, tree)
+		paths = append(paths, root)
+	}
+	return paths, size
+}
+
+func TestScanConcurrent(t *testing.T) {
+	const files, shared = 40, 15
+	roots, sharedSize := concurrentTree(t, 4, files, shared)
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Workers = 16
+
+	// read the Stats and Found as a progress line would, during the scans
+	done := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.Stats()
+				s.Found()
+			}
+		}
+	}()
+	for i, root := range roots {
+		st, err := s.ScanContext(context.Background(), root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := int64(0)
+		if i > 0 {
+			// the shared files are duplicates of those of the first root
+			want = sharedSize
+		}
+		if st.FilesSeen != files || st.FilesHashed != files || st.BytesReclaimable != want {
+			t.Errorf("root %d: saw %d files, hashed %d, %d reclaimable, want %d, %d and %d",
+				i, st.FilesSeen, st.FilesHashed, st.BytesReclaimable, files, files, want)
+		}
+		wantGroups := int64(0)
+		if i == 1 {
+			// each group is counted by the scan that found it
+			wantGroups = shared
+		}
+		if st.Groups != wantGroups {
+			t.Errorf("root %d: %d groups, want %d", i, st.Groups, wantGroups)
+		}
+	}
+	close(done)
+	<-polled
+
+	st := s.Stats()
+	if want := int64(len(roots) * files); st.FilesSeen != want || st.FilesHashed != want || st.FilesScanned != want {
+		t.Errorf("saw %d files, hashed %d, scanned %d, want %d", st.FilesSeen, st.FilesHashed, st.FilesScanned, want)
+	}
+	if want := int64(len(roots)-1) * sharedSize; st.BytesReclaimable != want {
+		t.Errorf("%d reclaimable in total, want %d", st.BytesReclaimable, want)
+	}
+	groups := groupPaths(t, store)
+	if len(groups) != shared {
+		t.Fatalf("%d groups, want %d", len(groups), shared)
+	}
+	for _, g := range groups {
+		if len(g) != len(roots) {
+			t.Errorf("group %q, want a file of each root", g)
+		}
+	}
+}
+
+func TestScanConcurrentCallers(t *testing.T) {
+	const files, shared = 30, 10
+	roots, sharedSize := concurrentTree(t, 4, files, shared)
+	s := newTestScanner(NewMapStore())
+	s.Workers = 8
+
+	// scans of a Scanner run one at a time, whoever calls them
+	var wg sync.WaitGroup
+	reclaimable := make([]int64, len(roots))
+	for i, root := range roots {
+		wg.Add(1)
+		go func(i int, root string) {
+			defer wg.Done()
+			st, err := s.ScanContext(context.Background(), root)
+			if err != nil {
+				t.Error(err)
+			}
+			reclaimable[i] = st.BytesReclaimable
+		}(i, root)
+	}
+	wg.Wait()
+
+	sum := int64(0)
+	for _, n := range reclaimable {
+		sum += n
+	}
+	st := s.Stats()
+	if want := int64(len(roots)-1) * sharedSize; sum != want || st.BytesReclaimable != want {
+		t.Errorf("%d reclaimable by the roots, %d in total, want %d", sum, st.BytesReclaimable, want)
+	}
+	if st.Groups != shared {
+		t.Errorf("%d groups, want %d", st.Groups, shared)
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	roots, _ := concurrentTree(t, 1, 50, 0)
+	store := NewMapStore()
+	s := newTestScanner(store)
+	s.Workers = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.ScanContext(ctx, roots[0]); err != context.Canceled {
+		t.Errorf("scan of a cancelled context: %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,218 @@
+package dups
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultPageSize and MaxPageSize bound the number of groups of a page of
+// the duplicate groups served
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// Server answers the queries of a hash database over HTTP, in JSON. It only
+// reads the database, and serves:
+//
+//	GET /hashes/DIGEST           the files of a content hash
+//	GET /files?path=PATH         the file at PATH, or the files under it
+//	GET /groups?offset=N&limit=N a page of the duplicate groups, the most
+//	                             reclaimable first
+//	GET /stats                   the DBStats of the database
+//
+// Errors are a JSON object with an "error" message.
+type Server struct {
+	DB  *SQLiteStore
+	mux *http.ServeMux
+}
+
+// NewServer returns a Server of the queries of db
+func NewServer(db *SQLiteStore) *Server {
+	srv := &Server{DB: db, mux: http.NewServeMux()}
+	srv.mux.HandleFunc("/hashes/", srv.hashes)
+	srv.mux.HandleFunc("/files", srv.files)
+	srv.mux.HandleFunc("/groups", srv.groups)
+	srv.mux.HandleFunc("/stats", srv.stats)
+	srv.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such path %q", r.URL.Path))
+	})
+	return srv
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	srv.mux.ServeHTTP(w, r)
+}
+
+// FileRecord is the record of a file served, with its content hash
+type FileRecord struct {
+	Hash string `json:"hash"`
+	Entry
+}
+
+// MarshalJSON writes the Entry of f along with its hash
+func (f FileRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash string `json:"hash"`
+		entryJSON
+	}{f.Hash, newEntryJSON(f.Entry)})
+}
+
+// HashRecords are the files of a content hash served
+type HashRecords struct {
+	Hash  string       `json:"hash"`
+	Files []FileRecord `json:"files"`
+}
+
+// GroupRecord is a duplicate group served
+type GroupRecord struct {
+	Hash        string  `json:"hash"`
+	Size        int64   `json:"size"`
+	Copies      int     `json:"copies"`
+	Reclaimable int64   `json:"reclaimable"`
+	Files       []Entry `json:"files"`
+}
+
+// NewGroupRecord returns the record of g served
+func NewGroupRecord(g Group) GroupRecord {
+	return GroupRecord{
+		Hash:        g.Hash,
+		Size:        g.Size(),
+		Copies:      g.Copies(),
+		Reclaimable: g.Reclaimable(),
+		Files:       g.Files,
+	}
+}
+
+// GroupsPage is a page of the duplicate groups served
+type GroupsPage struct {
+	// Total is the number of duplicate groups of all pages
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	Groups []GroupRecord `json:"groups"`
+}
+
+// hashes serves the files of the digest of the path, tagged or not
+func (srv *Server) hashes(w http.ResponseWriter, r *http.Request) {
+	digest := strings.TrimPrefix(r.URL.Path, "/hashes/")
+	if digest == "" || strings.Contains(digest, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such hash %q", digest))
+		return
+	}
+	digest = NormalizeDigest(digest)
+	entries, err := srv.DB.ByHash(digest)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no files of hash %s", digest))
+		return
+	}
+	writeJSON(w, HashRecords{Hash: digest, Files: fileRecords(entries)})
+}
+
+// files serves the record of the file at the path parameter, or those of the
+// files under it
+func (srv *Server) files(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing path parameter"))
+		return
+	}
+	entries, err := srv.DB.ByPath(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no files at %q", path))
+		return
+	}
+	writeJSON(w, fileRecords(entries))
+}
+
+// groups serves a page of the duplicate groups, of the offset and limit
+// parameters
+func (srv *Server) groups(w http.ResponseWriter, r *http.Request) {
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := intParam(r, "limit", DefaultPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if limit < 1 || limit > MaxPageSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be 1 to %d", MaxPageSize))
+		return
+	}
+	groups, total, err := srv.DB.DuplicateGroupsPage(offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page := GroupsPage{Total: total, Offset: offset, Limit: limit, Groups: []GroupRecord{}}
+	for _, g := range groups {
+		page.Groups = append(page.Groups, NewGroupRecord(g))
+	}
+	writeJSON(w, page)
+}
+
+// stats serves the DBStats of the database
+func (srv *Server) stats(w http.ResponseWriter, r *http.Request) {
+	st, err := srv.DB.Stats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, st)
+}
+
+func fileRecords(entries []Entry) []FileRecord {
+	records := make([]FileRecord, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, FileRecord{Hash: e.Hash, Entry: e})
+	}
+	return records
+}
+
+// intParam is the query parameter name of r, a number of at least 0, or def
+// when it is not set
+func intParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad %s %q", name, s)
+	}
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,208 @@
+package dups
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveDB writes a database of duplicates, some linked or in archives, and
+// returns it opened read-only, as served
+func serveDB(t *testing.T) *SQLiteStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hashes.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Entry{
+		{Hash: "sha256:aa", Path: "/a1", Size: 100},
+		{Hash: "sha256:aa", Path: "/a2", Size: 100},
+		{Hash: "sha256:aa", Path: "/a3", Size: 100},
+		// linked to each other
+		{Hash: "sha256:bb", Path: "/b1", DeviceID: "8:1", Inode: 7, Size: 500},
+		{Hash: "sha256:bb", Path: "/b2", DeviceID: "8:1", Inode: 7, Size: 500},
+		{Hash: "sha256:bb", Path: "/b3", DeviceID: "8:1", Inode: 8, Size: 500},
+		{Hash: "sha256:cc", Path: "/c1", DeviceID: "8:1", Inode: 9, Size: 50},
+		{Hash: "sha256:cc", Path: "/c2", DeviceID: "8:1", Inode: 9, Size: 50},
+		// a single file besides the member of an archive
+		{Hash: "sha256:dd", Path: "/d.tar" + ArchiveSep + "x", Size: 20},
+		{Hash: "sha256:dd", Path: "/d1", Size: 20},
+		{Hash: "sha256:ee", Path: "/E.ZIP" + ArchiveSep + "y", Size: 10},
+		{Hash: "sha256:ee", Path: "/e1", Size: 10},
+		{Hash: "sha256:ee", Path: "/e2", Size: 10},
+		// not in an archive
+		{Hash: "sha256:ff", Path: "/f" + ArchiveSep + "x", Size: 10},
+		{Hash: "sha256:ff", Path: "/f1", Size: 10},
+		{Hash: "sha256:11", Path: "/unique", Size: 1},
+		// directories of names differing by case alone
+		{Hash: "sha256:33", Path: "/dir/sub/x", Size: 3},
+		{Hash: "sha256:44", Path: "/dir/SUB/y", Size: 4},
+	} {
+		if err = db.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unsized := Group{Hash: "sha1:22", Files: []Entry{{Path: "/g1", Size: -1}, {Path: "/g2", Size: -1}}}
+	if _, err = db.ImportGroups([]Group{unsized}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = OpenSQLiteReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestDuplicateGroupsPage(t *testing.T) {
+	db := serveDB(t)
+	want, err := DuplicateGroups(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 5 {
+		t.Fatalf("%d duplicate groups, want 5", len(want))
+	}
+	for offset := 0; offset <= len(want); offset++ {
+		for limit := 1; limit <= 3; limit++ {
+			got, total, err := db.DuplicateGroupsPage(offset, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != len(want) {
+				t.Errorf("total %d, want %d", total, len(want))
+			}
+			end := offset + limit
+			if end > len(want) {
+				end = len(want)
+			}
+			if len(got) != end-offset {
+				t.Fatalf("%d groups from %d of %d, want %d", len(got), offset, limit, end-offset)
+			}
+			for i, g := range got {
+				w := want[offset+i]
+				if g.Hash != w.Hash || len(g.Files) != len(w.Files) || g.Reclaimable() != w.Reclaimable() {
+					t.Errorf("group %d from %d of %d: %s of %d files, want %s of %d",
+						i, offset, limit, g.Hash, len(g.Files), w.Hash, len(w.Files))
+				}
+			}
+		}
+	}
+
+	st, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaimable := int64(0)
+	for _, g := range want {
+		reclaimable += g.Reclaimable()
+	}
+	if st.DuplicateGroups != int64(len(want)) || st.Reclaimable != reclaimable {
+		t.Errorf("stats of %d groups, %d reclaimable, want %d and %d", st.DuplicateGroups, st.Reclaimable, len(want), reclaimable)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := httptest.NewServer(NewServer(serveDB(t)))
+	defer srv.Close()
+	get := func(method, path string, status int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s %s: status %d, want %d", method, path, resp.StatusCode, status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: content type %q", method, path, ct)
+		}
+		if v == nil {
+			v = &struct {
+				Error string `json:"error"`
+			}{}
+		}
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+
+	var hashes HashRecords
+	get("GET", "/hashes/sha256:aa", http.StatusOK, &hashes)
+	if hashes.Hash != "sha256:aa" || len(hashes.Files) != 3 || hashes.Files[0].Path != "/a1" {
+		t.Errorf("hashes %+v", hashes)
+	}
+	get("GET", "/hashes/sha256:00", http.StatusNotFound, nil)
+	get("GET", "/hashes/", http.StatusNotFound, nil)
+
+	var files []FileRecord
+	get("GET", "/files?path=/b2", http.StatusOK, &files)
+	if len(files) != 1 || files[0].Hash != "sha256:bb" || files[0].Inode != 7 {
+		t.Errorf("files %+v", files)
+	}
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/dir/sub", []string{"/dir/sub/x"}},
+		{"/dir/SUB/", []string{"/dir/SUB/y"}},
+		{"/dir", []string{"/dir/sub/x", "/dir/SUB/y"}},
+	} {
+		files = nil
+		get("GET", "/files?path="+tc.path, http.StatusOK, &files)
+		var got []string
+		for _, f := range files {
+			got = append(got, f.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("files of %s %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	get("GET", "/files?path=/Dir", http.StatusNotFound, nil)
+	get("GET", "/files?path=/missing", http.StatusNotFound, nil)
+	get("GET", "/files", http.StatusBadRequest, nil)
+
+	var page GroupsPage
+	get("GET", "/groups?offset=1&limit=2", http.StatusOK, &page)
+	if page.Total != 5 || page.Offset != 1 || page.Limit != 2 || len(page.Groups) != 2 {
+		t.Fatalf("page %+v", page)
+	}
+	// the linked group of 500 bytes reclaimable comes first
+	if g := page.Groups[0]; g.Hash != "sha256:aa" || g.Copies != 3 || g.Reclaimable != 200 || len(g.Files) != 3 {
+		t.Errorf("first group of the page %+v", g)
+	}
+	page = GroupsPage{}
+	get("GET", "/groups?offset=10", http.StatusOK, &page)
+	if page.Total != 5 || page.Limit != DefaultPageSize || page.Groups == nil || len(page.Groups) != 0 {
+		t.Errorf("page past the end %+v", page)
+	}
+	get("GET", "/groups?limit=0", http.StatusBadRequest, nil)
+	get("GET", "/groups?offset=-1", http.StatusBadRequest, nil)
+
+	var st DBStats
+	get("GET", "/stats", http.StatusOK, &st)
+	if st.SchemaVersion != SchemaVersion() || st.Records != 20 || st.DuplicateGroups != 5 {
+		t.Errorf("stats %+v", st)
+	}
+
+	get("POST", "/stats", http.StatusMethodNotAllowed, nil)
+	get("GET", "/nothing", http.StatusNotFound, nil)
+}
+
+func TestServerNotWritable(t *testing.T) {
+	db := serveDB(t)
+	err := db.Put(Entry{Hash: "sha256:aa", Path: "/new", Size: 100})
+	if err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("Put to the database served: %v, want a read-only error", err)
+	}
+}
@@ -0,0 +1,302 @@
+package dups
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteTimeFormat keeps the nanoseconds, and parses the whole seconds of
+// older rows too
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999"
+
+// SQLiteStore is a Store backed by the file_hashes table of a sqlite3 database.
+// The hash column holds the hex sum, and the algorithm column its Algorithm.
+// The errors of scans are logged to the scan_errors table.
+type SQLiteStore struct {
+	DB *sql.DB
+
+	get, put, touch *sql.Stmt
+}
+
+// sqliteOptions have the database written ahead to a log, so that reading
+// does not wait on writing, and synced less often than each commit
+const sqliteOptions = "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000"
+
+const (
+	sqliteGet = "SELECT hash, algorithm, size, device_id, inode, modified_time, changed_time FROM file_hashes WHERE file_path = ?"
+	sqlitePut = `INSERT INTO file_hashes (hash, algorithm, file_path, device_id, inode, size, modified_time, changed_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_path) DO UPDATE SET hash = excluded.hash, algorithm = excluded.algorithm, device_id = excluded.device_id,
+			inode = excluded.inode, size = excluded.size, modified_time = excluded.modified_time, changed_time = excluded.changed_time,
+			checked_time = CURRENT_TIMESTAMP`
+	sqliteTouch = "UPDATE file_hashes SET checked_time = CURRENT_TIMESTAMP WHERE file_path = ?"
+)
+
+// OpenSQLite opens (or creates) the sqlite3 database at path, and upgrades
+// its schema to the latest version
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", sqliteURI(path, sqliteOptions))
+	if err != nil {
+		return nil, err
+	}
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newSQLiteStore(db)
+}
+
+// OpenSQLiteReadOnly opens the existing sqlite3 database at path for reading
+// only. Its schema is not upgraded, so it must be of the latest version
+// already.
+func OpenSQLiteReadOnly(path string) (*SQLiteStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", sqliteURI(path, "?mode=ro&_busy_timeout=5000"))
+	if err != nil {
+		return nil, err
+	}
+	var version int
+	if err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database %s has no schema version, and needs opening by dups once to upgrade it: %v", path, err)
+	}
+	if version != SchemaVersion() {
+		db.Close()
+		return nil, fmt.Errorf("database %s has schema version %d, not %d, and needs opening by dups once to upgrade it", path, version, SchemaVersion())
+	}
+	return newSQLiteStore(db)
+}
+
+// sqliteURI is the URI of the database at path, with the options, escaping
+// the characters of path that would start them
+func sqliteURI(path, options string) string {
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path) + options
+}
+
+// newSQLiteStore prepares the statements of a SQLiteStore of db
+func newSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	var err error
+	s := &SQLiteStore{DB: db}
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{{&s.get, sqliteGet}, {&s.put, sqlitePut}, {&s.touch, sqliteTouch}} {
+		if *p.stmt, err = db.Prepare(p.query); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Get returns the record for path. Rows without a size (as imported from a
+// JSON hash map) are not usable.
+func (s *SQLiteStore) Get(path string) (Entry, bool, error) {
+	var (
+		e        = Entry{Path: path}
+		hash     string
+		alg      string
+		size     sql.NullInt64
+		inode    sql.NullInt64
+		deviceID sql.NullString
+		modTime  interface{}
+		cTime    interface{}
+	)
+	row := s.get.QueryRow(path)
+	err := row.Scan(&hash, &alg, &size, &deviceID, &inode, &modTime, &cTime)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if !size.Valid {
+		return Entry{}, false, nil
+	}
+	e.Hash = joinDigest(alg, hash)
+	e.Size = size.Int64
+	e.DeviceID = deviceID.String
+	e.Inode = uint64(inode.Int64)
+	e.ModTime = scanTime(modTime)
+	e.CTime = scanTime(cTime)
+	return e, true, nil
+}
+
+// Put inserts e, or updates the existing record of its path
+func (s *SQLiteStore) Put(e Entry) error {
+	return putEntry(s.put, e)
+}
+
+func putEntry(stmt *sql.Stmt, e Entry) error {
+	alg, hash := SplitDigest(e.Hash)
+	_, err := stmt.Exec(hash, string(alg), e.Path, e.DeviceID, int64(e.Inode), e.Size, formatTime(e.ModTime), formatTime(e.CTime))
+	return err
+}
+
+// Touch updates the checked_time of path
+func (s *SQLiteStore) Touch(path string) error {
+	_, err := s.touch.Exec(path)
+	return err
+}
+
+// Batch records puts, and updates the checked_time of touches, in a single
+// transaction
+func (s *SQLiteStore) Batch(puts []Entry, touches []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	put, touch := tx.Stmt(s.put), tx.Stmt(s.touch)
+	for _, e := range puts {
+		if err = putEntry(put, e); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, path := range touches {
+		if _, err = touch.Exec(path); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Each calls fn for every row of file_hashes, in the order they were inserted
+func (s *SQLiteStore) Each(fn func(Entry) error) error {
+	return s.each(fn, "")
+}
+
+// each calls fn for the rows of file_hashes matching the where clause, if
+// any, in the order they were inserted
+func (s *SQLiteStore) each(fn func(Entry) error, where string, args ...interface{}) error {
+	query := "SELECT hash, algorithm, file_path, device_id, inode, size, modified_time, changed_time FROM file_hashes"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := s.DB.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			e        Entry
+			hash     string
+			alg      string
+			size     sql.NullInt64
+			inode    sql.NullInt64
+			deviceID sql.NullString
+			modTime  interface{}
+			cTime    interface{}
+		)
+		if err = rows.Scan(&hash, &alg, &e.Path, &deviceID, &inode, &size, &modTime, &cTime); err != nil {
+			return err
+		}
+		e.Hash = joinDigest(alg, hash)
+		e.Size = -1
+		if size.Valid {
+			e.Size = size.Int64
+		}
+		e.DeviceID = deviceID.String
+		e.Inode = uint64(inode.Int64)
+		e.ModTime = scanTime(modTime)
+		e.CTime = scanTime(cTime)
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// RecordError logs e to the scan_errors table
+func (s *SQLiteStore) RecordError(e *ScanError) error {
+	_, err := s.DB.Exec("INSERT INTO scan_errors (file_path, op, kind, message) VALUES (?, ?, ?, ?)",
+		e.Path, e.Op, e.Kind, e.Err.Error())
+	return err
+}
+
+// ImportGroups inserts every file of groups, in a single transaction. Files
+// without a recorded device get it from the filesystem, if they still exist.
+// Records that fail to insert are skipped. It returns the number of records
+// inserted.
+func (s *SQLiteStore) ImportGroups(groups []Group) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO file_hashes (hash, algorithm, file_path, device_id, inode, size, modified_time, changed_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for _, g := range groups {
+		for _, e := range g.Files {
+			// If file doesn't exist, skip device ID
+			if e.DeviceID == "" {
+				if info, err := os.Stat(e.Path); err == nil {
+					e.DeviceID = NewEntry(e.Path, "", info).DeviceID
+				}
+			}
+			var size, inode interface{}
+			if e.Size >= 0 {
+				size = e.Size
+			}
+			if e.Inode != 0 {
+				inode = int64(e.Inode)
+			}
+			alg, hash := SplitDigest(g.Hash)
+			if _, err = stmt.Exec(hash, string(alg), e.Path, e.DeviceID, inode, size, formatTime(e.ModTime), formatTime(e.CTime)); err != nil {
+				continue
+			}
+			count++
+		}
+	}
+	return count, tx.Commit()
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.get, s.put, s.touch} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return s.DB.Close()
+}
+
+// formatTime converts t to the local time text of a DATETIME column, or NULL
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Local().Format(sqliteTimeFormat)
+}
+
+// scanTime converts a DATETIME column value, which the driver returns either
+// parsed (as UTC) or as text, to a time.Time. The column holds local time.
+func scanTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+	case string:
+		if pt, err := time.ParseInLocation(sqliteTimeFormat, t, time.Local); err == nil {
+			return pt
+		}
+	case []byte:
+		if pt, err := time.ParseInLocation(sqliteTimeFormat, string(t), time.Local); err == nil {
+			return pt
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,148 @@
+package dups
+
+import (
+	"database/sql"
+)
+
+// GetChunks returns the record of the chunks of path of params p
+func (s *SQLiteStore) GetChunks(path string, p ChunkParams) (ChunkedFile, bool, error) {
+	f := ChunkedFile{Path: path, Params: p}
+	var (
+		id             int64
+		modTime, cTime interface{}
+	)
+	err := s.DB.QueryRow("SELECT id, size, modified_time, changed_time FROM chunked_files WHERE file_path = ? AND params = ?",
+		path, p.String()).Scan(&id, &f.Size, &modTime, &cTime)
+	if err == sql.ErrNoRows {
+		return ChunkedFile{}, false, nil
+	}
+	if err != nil {
+		return ChunkedFile{}, false, err
+	}
+	f.ModTime = scanTime(modTime)
+	f.CTime = scanTime(cTime)
+
+	rows, err := s.DB.Query("SELECT offset, size, hash FROM chunks WHERE file_id = ? ORDER BY offset", id)
+	if err != nil {
+		return ChunkedFile{}, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Chunk
+		if err = rows.Scan(&c.Offset, &c.Size, &c.Hash); err != nil {
+			return ChunkedFile{}, false, err
+		}
+		f.Chunks = append(f.Chunks, c)
+	}
+	return f, true, rows.Err()
+}
+
+// PutChunks records the chunks of f, in a single transaction, replacing the
+// earlier ones of its path and params
+func (s *SQLiteStore) PutChunks(f ChunkedFile) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM chunks WHERE file_id IN
+	(SELECT id FROM chunked_files WHERE file_path = ? AND params = ?)`, f.Path, f.Params.String()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO chunked_files (file_path, params, size, modified_time, changed_time) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (file_path, params) DO UPDATE SET size = excluded.size, modified_time = excluded.modified_time,
+	changed_time = excluded.changed_time, checked_time = CURRENT_TIMESTAMP`,
+		f.Path, f.Params.String(), f.Size, formatTime(f.ModTime), formatTime(f.CTime))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var id int64
+	if err = tx.QueryRow("SELECT id FROM chunked_files WHERE file_path = ? AND params = ?", f.Path, f.Params.String()).Scan(&id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO chunks (file_id, offset, size, hash) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range f.Chunks {
+		if _, err = stmt.Exec(id, c.Offset, c.Size, c.Hash); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AnalyzeChunks sums up the recorded chunks of params p of the files at
+// paths in sql, as ChunkScanner.Analyze does in memory. The files without a
+// record are left out.
+func (s *SQLiteStore) AnalyzeChunks(paths []string, p ChunkParams, top int) (ChunkAnalysis, error) {
+	a := ChunkAnalysis{Params: p, Pairs: []ChunkPair{}}
+	// the temporary table of the files is of the connection of the
+	// transaction, and dropped with its rollback
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return a, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("CREATE TEMP TABLE analyzed_files (id INTEGER PRIMARY KEY, file_path TEXT NOT NULL)"); err != nil {
+		return a, err
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO analyzed_files SELECT id, file_path FROM chunked_files WHERE file_path = ? AND params = ?")
+	if err != nil {
+		return a, err
+	}
+	defer stmt.Close()
+	for _, path := range paths {
+		if _, err = stmt.Exec(path, p.String()); err != nil {
+			return a, err
+		}
+	}
+
+	if err = tx.QueryRow("SELECT COUNT(*) FROM analyzed_files").Scan(&a.Files); err != nil {
+		return a, err
+	}
+	err = tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM chunks
+	WHERE file_id IN (SELECT id FROM analyzed_files)`).Scan(&a.Chunks, &a.Bytes)
+	if err != nil {
+		return a, err
+	}
+	err = tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0), COALESCE(SUM(files > ?), 0) FROM
+	(SELECT MIN(size) AS size, COUNT(DISTINCT file_id) AS files FROM chunks
+		WHERE file_id IN (SELECT id FROM analyzed_files) GROUP BY hash)`,
+		MaxPairedFiles).Scan(&a.UniqueChunks, &a.UniqueBytes, &a.CommonChunks)
+	if err != nil {
+		return a, err
+	}
+	a.Savings = a.Bytes - a.UniqueBytes
+
+	limit := -1
+	if top > 0 {
+		limit = top
+	}
+	rows, err := tx.Query(`WITH files_chunks AS (SELECT DISTINCT c.hash, c.size, f.file_path FROM chunks c
+		JOIN analyzed_files f ON f.id = c.file_id),
+	paired AS (SELECT hash FROM files_chunks GROUP BY hash HAVING COUNT(*) BETWEEN 2 AND ?)
+SELECT x.file_path, y.file_path, SUM(x.size) AS shared FROM files_chunks x
+	JOIN files_chunks y ON y.hash = x.hash AND x.file_path < y.file_path
+	WHERE x.hash IN (SELECT hash FROM paired)
+	GROUP BY x.file_path, y.file_path
+	ORDER BY shared DESC, x.file_path, y.file_path
+	LIMIT ?`, MaxPairedFiles, limit)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pair ChunkPair
+		if err = rows.Scan(&pair.A, &pair.B, &pair.Shared); err != nil {
+			return a, err
+		}
+		a.Pairs = append(a.Pairs, pair)
+	}
+	return a, rows.Err()
+}
@@ -0,0 +1,58 @@
+package dups
+
+// GetImage returns the record of the perceptual hash alg of path
+func (s *SQLiteStore) GetImage(path string, alg ImageAlgorithm) (ImageEntry, bool, error) {
+	rows, err := s.images("i.file_path = ? AND i.algorithm = ?", path, string(alg))
+	if err != nil || len(rows) == 0 {
+		return ImageEntry{}, false, err
+	}
+	return rows[0], true, nil
+}
+
+// PutImage inserts e, or updates the existing record of its path and
+// algorithm
+func (s *SQLiteStore) PutImage(e ImageEntry) error {
+	_, err := s.DB.Exec(`INSERT INTO image_hashes (file_path, algorithm, hash, size, modified_time, changed_time)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (file_path, algorithm) DO UPDATE SET hash = excluded.hash, size = excluded.size,
+	modified_time = excluded.modified_time, changed_time = excluded.changed_time, checked_time = CURRENT_TIMESTAMP`,
+		e.Path, string(e.Algorithm), e.Hash.String(), e.Size, formatTime(e.ModTime), formatTime(e.CTime))
+	return err
+}
+
+// Images returns the records of the perceptual hash alg, with the content
+// hash of their file when it is recorded too
+func (s *SQLiteStore) Images(alg ImageAlgorithm) ([]ImageEntry, error) {
+	return s.images("i.algorithm = ?", string(alg))
+}
+
+// images returns the rows of image_hashes matching the where clause
+func (s *SQLiteStore) images(where string, args ...interface{}) ([]ImageEntry, error) {
+	rows, err := s.DB.Query(`SELECT i.file_path, i.algorithm, i.hash, i.size, i.modified_time, i.changed_time,
+	COALESCE(f.algorithm || ':' || f.hash, '')
+FROM image_hashes i LEFT JOIN file_hashes f ON f.file_path = i.file_path
+WHERE `+where+` ORDER BY i.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var images []ImageEntry
+	for rows.Next() {
+		var (
+			e              ImageEntry
+			alg, hash      string
+			modTime, cTime interface{}
+		)
+		if err = rows.Scan(&e.Path, &alg, &hash, &e.Size, &modTime, &cTime, &e.Digest); err != nil {
+			return nil, err
+		}
+		e.Algorithm = ImageAlgorithm(alg)
+		if err = e.Hash.UnmarshalText([]byte(hash)); err != nil {
+			return nil, err
+		}
+		e.ModTime = scanTime(modTime)
+		e.CTime = scanTime(cTime)
+		images = append(images, e)
+	}
+	return images, rows.Err()
+}
@@ -0,0 +1,295 @@
+package dups
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+)
+
+// PruneReason describes why Prune dropped the record of a file
+type PruneReason struct {
+	Path   string
+	Reason string
+}
+
+// Prune drops the records of the files that vanished, or changed since they
+// were hashed, and, when unchecked is not zero, those not checked by a scan
+// since then. With dryRun, the records are only reported. It returns the
+// records dropped, and why.
+func (s *SQLiteStore) Prune(unchecked time.Time, dryRun bool) ([]PruneReason, error) {
+	var pruned []PruneReason
+	err := s.each(func(e Entry) error {
+		if archive, _, ok := SplitMemberPath(e.Path); ok {
+			if why := memberChanged(archive, e); why != "" {
+				pruned = append(pruned, PruneReason{Path: e.Path, Reason: why})
+			}
+			return nil
+		}
+		info, err := os.Stat(e.Path)
+		switch {
+		case err != nil:
+			pruned = append(pruned, PruneReason{Path: e.Path, Reason: err.Error()})
+		case !info.Mode().IsRegular():
+			pruned = append(pruned, PruneReason{Path: e.Path, Reason: "not a regular file"})
+		case e.Size >= 0:
+			// older records are compared by what they have, not as changed
+			// for lacking the ctime, inode or nanoseconds of newer ones
+			if why := e.Changed(e.recorded(NewEntry(e.Path, e.Hash, info))); why != "" {
+				pruned = append(pruned, PruneReason{Path: e.Path, Reason: "changed " + why})
+			}
+		}
+		return nil
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if !unchecked.IsZero() {
+		// checked_time is set by sqlite, in UTC
+		rows, err := s.DB.Query("SELECT file_path, checked_time FROM file_hashes WHERE checked_time < ? ORDER BY id",
+			unchecked.UTC().Format(sqliteTimeFormat))
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, p := range pruned {
+			seen[p.Path] = true
+		}
+		for rows.Next() {
+			var (
+				path    string
+				checked interface{}
+			)
+			if err = rows.Scan(&path, &checked); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !seen[path] {
+				pruned = append(pruned, PruneReason{Path: path, Reason: "not checked since " + formatChecked(checked)})
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun || len(pruned) == 0 {
+		return pruned, nil
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// the chunks of files go with the records of their file too
+	var stmts []*sql.Stmt
+	for _, query := range []string{
+		"DELETE FROM file_hashes WHERE file_path = ?",
+		"DELETE FROM chunks WHERE file_id IN (SELECT id FROM chunked_files WHERE file_path = ?)",
+		"DELETE FROM chunked_files WHERE file_path = ?",
+	} {
+		stmt, err := tx.Prepare(query)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		defer stmt.Close()
+		stmts = append(stmts, stmt)
+	}
+	for _, p := range pruned {
+		for _, stmt := range stmts {
+			if _, err = stmt.Exec(p.Path); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	// the perceptual hashes of images go with the records of their file
+	if _, err = tx.Exec("DELETE FROM image_hashes WHERE file_path NOT IN (SELECT file_path FROM file_hashes)"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return pruned, tx.Commit()
+}
+
+// formatChecked formats a checked_time value in local time
+func formatChecked(v interface{}) string {
+	t := scanCheckedTime(v)
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// scanCheckedTime converts a checked_time value, which sqlite sets in UTC
+func scanCheckedTime(v interface{}) time.Time {
+	t := scanTime(v)
+	if t.IsZero() {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// DBStats describes the content of a database
+type DBStats struct {
+	SchemaVersion int   `json:"schema_version"`
+	Records       int64 `json:"records"`
+	// Unsized counts the records without a size, as imported from a JSON
+	// hash map
+	Unsized int64 `json:"unsized"`
+	Hashes  int64 `json:"hashes"`
+	Bytes   int64 `json:"bytes"`
+	// Algorithms counts the records by the algorithm of their hash
+	Algorithms map[string]int64 `json:"algorithms"`
+	// DuplicateGroups counts the hashes of more than one copy, and
+	// Reclaimable the bytes of their extra copies
+	DuplicateGroups int64 `json:"duplicate_groups"`
+	Reclaimable     int64 `json:"reclaimable"`
+	// OldestChecked and NewestChecked are the range of the checked_time of
+	// the records
+	OldestChecked time.Time `json:"oldest_checked"`
+	NewestChecked time.Time `json:"newest_checked"`
+	// Errors counts the rows of the scan_errors table
+	Errors int64 `json:"errors"`
+}
+
+// Stats describes the content of the database
+func (s *SQLiteStore) Stats() (DBStats, error) {
+	st := DBStats{Algorithms: map[string]int64{}}
+	var (
+		oldest, newest interface{}
+		bytes          interface{}
+	)
+	row := s.DB.QueryRow(`SELECT COUNT(*), COUNT(*) - COUNT(size), COUNT(DISTINCT algorithm || ':' || hash), SUM(size),
+		MIN(checked_time), MAX(checked_time) FROM file_hashes`)
+	if err := row.Scan(&st.Records, &st.Unsized, &st.Hashes, &bytes, &oldest, &newest); err != nil {
+		return st, err
+	}
+	if n, ok := bytes.(int64); ok {
+		st.Bytes = n
+	}
+	st.OldestChecked = scanCheckedTime(oldest)
+	st.NewestChecked = scanCheckedTime(newest)
+
+	rows, err := s.DB.Query("SELECT algorithm, COUNT(*) FROM file_hashes GROUP BY algorithm")
+	if err != nil {
+		return st, err
+	}
+	for rows.Next() {
+		var (
+			alg string
+			n   int64
+		)
+		if err = rows.Scan(&alg, &n); err != nil {
+			rows.Close()
+			return st, err
+		}
+		st.Algorithms[alg] = n
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return st, err
+	}
+
+	row = s.DB.QueryRow("SELECT COUNT(*), IFNULL(SUM(reclaimable), 0) FROM (" + duplicateHashes() + ")")
+	if err = row.Scan(&st.DuplicateGroups, &st.Reclaimable); err != nil {
+		return st, err
+	}
+	if err = s.DB.QueryRow("SELECT COUNT(*) FROM scan_errors").Scan(&st.Errors); err != nil {
+		return st, err
+	}
+	st.SchemaVersion, err = s.SchemaVersion()
+	return st, err
+}
+
+// duplicateHashes selects the hashes of more than one independent copy, with
+// the size of a copy and the bytes of the others, counting the copies as
+// Group.Copies does. first is the id of their first record.
+func duplicateHashes() string {
+	members := make([]string, len(archiveExts))
+	for i, ext := range archiveExts {
+		// LIKE ignores the case of ASCII letters, as isArchive does
+		members[i] = "file_path LIKE '%" + ext + ArchiveSep + "%'"
+	}
+	return `SELECT algorithm, hash, first, size, (copies - 1) * size AS reclaimable FROM (
+	SELECT algorithm, hash, MIN(id) AS first, IFNULL(MAX(size), 0) AS size,
+		COUNT(DISTINCT CASE WHEN ` + strings.Join(members, " OR ") + ` THEN NULL
+			WHEN IFNULL(inode, 0) != 0 THEN 'inode ' || IFNULL(device_id, '') || ' ' || inode
+			ELSE 'path ' || file_path END) AS copies
+	FROM file_hashes GROUP BY algorithm, hash)
+WHERE copies > 1`
+}
+
+// DuplicateGroupsPage returns limit of the DuplicateGroups of s from offset,
+// in the same order, and the number of all of them. Only the records of the
+// groups of the page are read.
+func (s *SQLiteStore) DuplicateGroupsPage(offset, limit int) ([]Group, int, error) {
+	var total int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM (" + duplicateHashes() + ")").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.DB.Query("SELECT algorithm, hash FROM ("+duplicateHashes()+") ORDER BY reclaimable DESC, first LIMIT ? OFFSET ?",
+		limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	var digests []string
+	for rows.Next() {
+		var alg, hash string
+		if err = rows.Scan(&alg, &hash); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		digests = append(digests, joinDigest(alg, hash))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	groups := make([]Group, 0, len(digests))
+	for _, digest := range digests {
+		files, err := s.ByHash(digest)
+		if err != nil {
+			return nil, 0, err
+		}
+		groups = append(groups, Group{Hash: digest, Files: files})
+	}
+	return groups, total, nil
+}
+
+// Vacuum rebuilds the database file, returning the space of deleted rows to
+// the filesystem
+func (s *SQLiteStore) Vacuum() error {
+	_, err := s.DB.Exec("VACUUM")
+	return err
+}
+
+// ByHash returns the records of the content digest, which may be untagged
+func (s *SQLiteStore) ByHash(digest string) ([]Entry, error) {
+	alg, hash := SplitDigest(digest)
+	var entries []Entry
+	err := s.each(func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, "algorithm = ? AND hash = ?", string(alg), hash)
+	return entries, err
+}
+
+// ByPath returns the record of the file at path, or the records of the files
+// under it when it is a directory
+func (s *SQLiteStore) ByPath(path string) ([]Entry, error) {
+	dir := strings.TrimSuffix(path, string(os.PathSeparator)) + string(os.PathSeparator)
+	var entries []Entry
+	err := s.each(func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, "file_path = ? OR (file_path >= ? AND file_path < ?)", path, dir, dirEnd(dir))
+	return entries, err
+}
+
+// dirEnd is the first path after those under dir, which ends with a
+// separator, in the byte order sqlite compares text in by default
+func dirEnd(dir string) string {
+	return dir[:len(dir)-1] + string(dir[len(dir)-1]+1)
+}
@@ -0,0 +1,72 @@
+package dups
+
+import (
+	"time"
+)
+
+// TrashRun sums up the files moved to a Trash by one run
+type TrashRun struct {
+	Run   string    `json:"run"`
+	Files int64     `json:"files"`
+	Bytes int64     `json:"bytes"`
+	Moved time.Time `json:"moved"`
+}
+
+// RecordTrash logs the move of a file to a Trash to the trash table
+func (s *SQLiteStore) RecordTrash(f TrashedFile) error {
+	_, err := s.DB.Exec("INSERT INTO trash (run, file_path, trash_path, target, hash, size) VALUES (?, ?, ?, ?, ?, ?)",
+		f.Run, f.Path, f.TrashPath, f.Target, f.Hash, f.Size)
+	return err
+}
+
+// TrashRuns lists the runs with files in the trash, the latest first
+func (s *SQLiteStore) TrashRuns() ([]TrashRun, error) {
+	rows, err := s.DB.Query(`SELECT run, COUNT(*), COALESCE(SUM(size), 0), MIN(moved_time)
+FROM trash GROUP BY run ORDER BY run DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []TrashRun
+	for rows.Next() {
+		var (
+			r     TrashRun
+			moved interface{}
+		)
+		if err := rows.Scan(&r.Run, &r.Files, &r.Bytes, &moved); err != nil {
+			return nil, err
+		}
+		r.Moved = scanCheckedTime(moved)
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// Trashed returns the files moved to the trash by run
+func (s *SQLiteStore) Trashed(run string) ([]TrashedFile, error) {
+	rows, err := s.DB.Query(`SELECT id, run, file_path, trash_path, target, hash, size, moved_time
+FROM trash WHERE run = ? ORDER BY id`, run)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []TrashedFile
+	for rows.Next() {
+		var (
+			f     TrashedFile
+			moved interface{}
+		)
+		if err := rows.Scan(&f.ID, &f.Run, &f.Path, &f.TrashPath, &f.Target, &f.Hash, &f.Size, &moved); err != nil {
+			return nil, err
+		}
+		f.Moved = scanCheckedTime(moved)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// DropTrashed deletes the record of a file of the trash, once it is restored
+func (s *SQLiteStore) DropTrashed(id int64) error {
+	_, err := s.DB.Exec("DELETE FROM trash WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,13 @@
+package dups
+
+import "time"
+
+// fileStat is the part of the stat info of a file that is not in os.FileInfo
+type fileStat struct {
+	dev   uint64
+	ino   uint64
+	ctime time.Time
+	nlink uint64
+	uid   uint32
+	gid   uint32
+}
@@ -0,0 +1,12 @@
+//go:build aix || dragonfly || linux || openbsd || solaris
+
+package dups
+
+import (
+	"syscall"
+	"time"
+)
+
+func ctimeOf(st *syscall.Stat_t) time.Time {
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dups
+
+import "strconv"
+
+// formatDevice formats a device ID
+func formatDevice(dev uint64) string {
+	return strconv.FormatUint(dev, 10)
+}
@@ -0,0 +1,12 @@
+package dups
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// formatDevice formats a device ID as "major:minor", as mountinfo does
+func formatDevice(dev uint64) string {
+	return fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+}
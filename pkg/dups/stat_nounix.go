@@ -0,0 +1,11 @@
+//go:build !unix
+
+package dups
+
+import "os"
+
+// statOf is only implemented on unix, elsewhere files are compared by size
+// and mtime alone
+func statOf(info os.FileInfo) (fileStat, bool) {
+	return fileStat{}, false
+}
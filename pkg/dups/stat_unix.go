@@ -0,0 +1,23 @@
+//go:build unix
+
+package dups
+
+import (
+	"os"
+	"syscall"
+)
+
+func statOf(info os.FileInfo) (fileStat, bool) {
+	sysStat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+	return fileStat{
+		dev:   uint64(sysStat.Dev),
+		ino:   uint64(sysStat.Ino),
+		ctime: ctimeOf(sysStat),
+		nlink: uint64(sysStat.Nlink),
+		uid:   sysStat.Uid,
+		gid:   sysStat.Gid,
+	}, true
+}
@@ -0,0 +1,101 @@
+package dups
+
+import (
+	"sync"
+)
+
+// Store persists the Entry of each file that has been hashed
+type Store interface {
+	// Get returns the entry recorded for path. ok is false when there is no
+	// usable record for path.
+	Get(path string) (e Entry, ok bool, err error)
+	// Put records e, replacing any existing record for the same path
+	Put(e Entry) error
+	// Touch marks the record for path as checked just now
+	Touch(path string) error
+	// Each calls fn for every recorded entry, stopping at the first error
+	Each(fn func(Entry) error) error
+	Close() error
+}
+
+// BatchStore is implemented by the Stores that record many entries at once
+// faster than one at a time
+type BatchStore interface {
+	Store
+	// Batch records puts, and marks touches as checked just now, all at once
+	Batch(puts []Entry, touches []string) error
+}
+
+// MapStore is an in-memory Store, as loaded from a JSON hash map
+type MapStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+	order   []string
+}
+
+// NewMapStore returns an empty MapStore
+func NewMapStore() *MapStore {
+	return &MapStore{entries: map[string]Entry{}}
+}
+
+// NewMapStoreFromGroups returns a MapStore populated with the files of groups,
+// like those read by ReadGroups
+func NewMapStoreFromGroups(groups []Group) *MapStore {
+	ms := NewMapStore()
+	for _, g := range groups {
+		for _, e := range g.Files {
+			ms.Put(e)
+		}
+	}
+	return ms
+}
+
+// Get returns the entry for path. Entries without a known size (as loaded
+// from the older hash to path JSON format) are never reported as usable.
+func (ms *MapStore) Get(path string) (Entry, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, ok := ms.entries[path]
+	if !ok || e.Size < 0 {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+// Put records e, replacing any existing record for its path
+func (ms *MapStore) Put(e Entry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.entries[e.Path]; !ok {
+		ms.order = append(ms.order, e.Path)
+	}
+	ms.entries[e.Path] = e
+	return nil
+}
+
+// Touch is a no-op, as a MapStore keeps no check times
+func (ms *MapStore) Touch(path string) error {
+	return nil
+}
+
+// Each calls fn for every entry, in the order they were recorded
+func (ms *MapStore) Each(fn func(Entry) error) error {
+	ms.mu.Lock()
+	entries := make([]Entry, 0, len(ms.order))
+	for _, path := range ms.order {
+		entries = append(entries, ms.entries[path])
+	}
+	ms.mu.Unlock()
+
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op
+func (ms *MapStore) Close() error {
+	return nil
+}
@@ -0,0 +1,286 @@
+package dups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStores returns the Stores to test, each empty
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Store{"map": NewMapStore(), "sqlite": db}
+}
+
+func TestStorePutGet(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			e := Entry{Hash: "sha256:aa", Path: "/a", DeviceID: "8:1", Inode: 12, Size: 34, ModTime: mtime, CTime: mtime}
+			if err := st.Put(e); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := st.Get("/a")
+			if err != nil || !ok {
+				t.Fatalf("Get: %v, %v", ok, err)
+			}
+			if got.Hash != e.Hash || got.Size != e.Size || got.Inode != e.Inode || got.DeviceID != e.DeviceID ||
+				!got.ModTime.Equal(mtime) || !got.CTime.Equal(mtime) {
+				t.Errorf("Get %+v, want %+v", got, e)
+			}
+
+			// Put replaces the record of the path
+			e.Hash, e.Size = "sha256:bb", 56
+			if err = st.Put(e); err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _ = st.Get("/a"); got.Hash != "sha256:bb" || got.Size != 56 {
+				t.Errorf("Get after Put %+v, want %+v", got, e)
+			}
+
+			if _, ok, err = st.Get("/missing"); ok || err != nil {
+				t.Errorf("Get of a missing path: %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStoreUnsized(t *testing.T) {
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// records without a size, as imported from the older JSON map,
+			// are never usable
+			groups := []Group{{Hash: "sha1:cc", Files: []Entry{{Hash: "sha1:cc", Path: "/old", Size: -1}}}}
+			if db, ok := st.(*SQLiteStore); ok {
+				if _, err := db.ImportGroups(groups); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := st.Put(groups[0].Files[0]); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, err := st.Get("/old"); ok || err != nil {
+				t.Errorf("Get of an unsized record: %v, %v", ok, err)
+			}
+			n := 0
+			st.Each(func(e Entry) error {
+				n++
+				return nil
+			})
+			if n != 1 {
+				t.Errorf("Each saw %d records, want 1", n)
+			}
+		})
+	}
+}
+
+func TestStoreEachOrder(t *testing.T) {
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			paths := []string{"/c", "/a", "/b"}
+			for i, p := range paths {
+				if err := st.Put(Entry{Hash: "sha256:aa", Path: p, Size: int64(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			if err := st.Each(func(e Entry) error {
+				got = append(got, e.Path)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(paths) {
+				t.Fatalf("Each %q, want %q", got, paths)
+			}
+			for i := range paths {
+				if got[i] != paths[i] {
+					t.Errorf("Each %q, want %q in the order recorded", got, paths)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteBatchReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	puts := []Entry{
+		{Hash: "sha256:aa", Path: "/a", Size: 1},
+		{Hash: "sha256:aa", Path: "/b", Size: 1},
+		{Hash: "xxhash:bb", Path: "/c", Size: 2},
+	}
+	if err = db.Batch(puts, []string{"/a"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = OpenSQLite(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, want := range puts {
+		got, ok, err := db.Get(want.Path)
+		if err != nil || !ok {
+			t.Fatalf("Get %s after reopening: %v, %v", want.Path, ok, err)
+		}
+		if got.Hash != want.Hash || got.Size != want.Size {
+			t.Errorf("Get %+v, want %+v", got, want)
+		}
+	}
+	if got := groupPaths(t, db); len(got) != 1 || len(got[0]) != 2 {
+		t.Errorf("groups %q, want /a and /b", got)
+	}
+}
+
+func TestScanSQLite(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "dup", "b": "dup", "c": "one"})
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = newTestScanner(db).Scan(root); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, ok, err := db.Get(filepath.Join(root, name)); !ok || err != nil {
+			t.Errorf("no record of %s: %v", name, err)
+		}
+	}
+	got := groupPaths(t, db)
+	if len(got) != 1 || got[0][0] != filepath.Join(root, "a") || got[0][1] != filepath.Join(root, "b") {
+		t.Errorf("groups %q, want a and b", got)
+	}
+}
+
+// benchEntries returns n entries of distinct paths
+func benchEntries(n int) []Entry {
+	entries := make([]Entry, n)
+	mtime := time.Now()
+	for i := range entries {
+		entries[i] = Entry{
+			Hash:     fmt.Sprintf("sha256:%064x", i%1000),
+			Path:     fmt.Sprintf("/bench/%d/file%d", i%100, i),
+			DeviceID: "8:1",
+			Inode:    uint64(i),
+			Size:     int64(i),
+			ModTime:  mtime,
+			CTime:    mtime,
+		}
+	}
+	return entries
+}
+
+func benchSQLite(b *testing.B) *SQLiteStore {
+	db, err := OpenSQLite(filepath.Join(b.TempDir(), "hashes.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// BenchmarkSQLitePut writes each record in a transaction of its own
+func BenchmarkSQLitePut(b *testing.B) {
+	db := benchSQLite(b)
+	entries := benchEntries(b.N)
+	b.ResetTimer()
+	for _, e := range entries {
+		if err := db.Put(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSQLiteBatch writes the records DefaultBatchSize at a time, as a
+// Scanner does
+func BenchmarkSQLiteBatch(b *testing.B) {
+	db := benchSQLite(b)
+	entries := benchEntries(b.N)
+	b.ResetTimer()
+	for len(entries) > 0 {
+		n := DefaultBatchSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		if err := db.Batch(entries[:n], nil); err != nil {
+			b.Fatal(err)
+		}
+		entries = entries[n:]
+	}
+}
+
+func TestSQLiteByPath(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, path := range []string{"/t/a/b", "/t/a/b/x", "/t/a/b/y/z", "/t/a/B/x", "/t/a/bc", "/t/a/b_", "/t/a/b%/x", "/t/a/b0"} {
+		if err = db.Put(Entry{Hash: "sha256:aa", Path: path, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/t/a/b", []string{"/t/a/b", "/t/a/b/x", "/t/a/b/y/z"}},
+		{"/t/a/b/", []string{"/t/a/b/x", "/t/a/b/y/z"}},
+		{"/t/a/B", []string{"/t/a/B/x"}},
+		{"/t/a/b%", []string{"/t/a/b%/x"}},
+		{"/t/a/b_", []string{"/t/a/b_"}},
+		{"/t/A", nil},
+	} {
+		entries, err := db.ByPath(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ByPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestOpenSQLiteOddPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a?b#c%20d.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode string
+	if err = db.DB.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal mode %q, want wal: %v", mode, err)
+	}
+	if err = db.Put(Entry{Hash: "sha256:aa", Path: "/a", Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("the database is not at its path: %v", err)
+	}
+
+	if db, err = OpenSQLiteReadOnly(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok, err := db.Get("/a"); err != nil || !ok {
+		t.Errorf("Get after reopening: %v, %v", ok, err)
+	}
+}
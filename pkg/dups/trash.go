@@ -0,0 +1,213 @@
+package dups
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Trash is a quarantine directory that duplicates are moved into, instead of
+// being linked, for them to be restored if need be. Each file is moved to its
+// absolute path under Dir.
+type Trash struct {
+	Dir string
+	// Run identifies the files moved by one run, to restore them together
+	Run string
+}
+
+// NewTrash returns a Trash of dir, for a run identified by the current time
+func NewTrash(dir string) (*Trash, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Trash{Dir: abs, Run: runID()}, nil
+}
+
+// runID identifies a run by the current time
+func runID() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// TrashedFile is the record of a file moved to a Trash
+type TrashedFile struct {
+	ID  int64  `json:"id,omitempty"`
+	Run string `json:"run"`
+	// Path is where the file was, and TrashPath where it is now
+	Path      string `json:"path"`
+	TrashPath string `json:"trash_path"`
+	// Target is the file of the same content that was kept
+	Target string    `json:"target"`
+	Hash   string    `json:"hash"`
+	Size   int64     `json:"size"`
+	Moved  time.Time `json:"moved"`
+}
+
+// TrashRecorder is implemented by the Stores that keep a record of the files
+// moved to a Trash
+type TrashRecorder interface {
+	RecordTrash(f TrashedFile) error
+}
+
+// contains reports whether path is the Dir of t, or under it
+func (t *Trash) contains(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(t.Dir, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Move moves the file at path into t, returning where it now is. A file
+// already in t at that path is left alone, and the new one gets a numbered
+// suffix.
+func (t *Trash) Move(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(t.Dir, strings.TrimPrefix(abs, filepath.VolumeName(abs)))
+	dest := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			break
+		}
+		dest = base + "." + strconv.Itoa(i)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
+		return "", err
+	}
+	return dest, moveFile(path, dest)
+}
+
+// Put moves the file of f.Path into t, as Move does, and records the move
+// with rec, if set. When the record fails, the file is moved back, for no
+// file to be left in t without a record to restore it by. It returns f with
+// its Run and TrashPath set.
+func (t *Trash) Put(f TrashedFile, rec TrashRecorder) (TrashedFile, error) {
+	dest, err := t.Move(f.Path)
+	if err != nil {
+		return f, err
+	}
+	f.Run, f.TrashPath = t.Run, dest
+	if rec == nil {
+		return f, nil
+	}
+	if err = rec.RecordTrash(f); err != nil {
+		if backErr := moveFile(dest, f.Path); backErr != nil {
+			return f, fmt.Errorf("recording the move of %s: %v, and moving it back from %s: %v", f.Path, err, dest, backErr)
+		}
+		return f, fmt.Errorf("recording the move of %s: %v", f.Path, err)
+	}
+	return f, nil
+}
+
+// Restore moves f back to its path, unless another file took its place. A
+// *ChangedError is returned when the file in the trash no longer has the
+// content of f.
+func (f TrashedFile) Restore() error {
+	if _, err := os.Lstat(f.Path); err == nil {
+		return &SkipError{Reason: fmt.Sprintf("%s exists again", f.Path)}
+	}
+	if _, err := os.Lstat(f.TrashPath); err != nil {
+		return err
+	}
+	if f.Hash != "" {
+		alg, _ := SplitDigest(f.Hash)
+		sum, err := hashFile(f.TrashPath, alg)
+		if err != nil {
+			return err
+		}
+		if sum != f.Hash {
+			return &ChangedError{Path: f.TrashPath, Want: f.Hash, Got: sum}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return err
+	}
+	return moveFile(f.TrashPath, f.Path)
+}
+
+// moveFile renames oldpath to newpath, or copies it over and removes it when
+// they are on different filesystems
+func moveFile(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return moveAcross(oldpath, newpath)
+}
+
+// moveAcross copies oldpath to newpath with its owner, mode, xattrs and mtime,
+// and removes it. The file is not moved when any of them can not be kept.
+func moveAcross(oldpath, newpath string) error {
+	info, err := os.Lstat(oldpath)
+	if err != nil {
+		return err
+	}
+	attrs, err := xattrs(oldpath)
+	if err != nil {
+		return err
+	}
+	if err = copyFile(oldpath, newpath); err != nil {
+		os.Remove(newpath)
+		return err
+	}
+	if err = copyMetadata(newpath, info, attrs); err != nil {
+		os.Remove(newpath)
+		return fmt.Errorf("moving %s to another filesystem: %v", oldpath, err)
+	}
+	return os.Remove(oldpath)
+}
+
+// copyMetadata gives the file at path the owner and mode of info, and the
+// xattrs attrs, then the mtime of info
+func copyMetadata(path string, info os.FileInfo, attrs map[string]string) error {
+	if st, ok := statOf(info); ok {
+		if err := os.Lchown(path, int(st.uid), int(st.gid)); err != nil {
+			return err
+		}
+	}
+	// after the owner, which clears the setuid and setgid bits
+	if err := os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		if err := setxattr(path, name, value); err != nil {
+			return fmt.Errorf("xattr %s: %v", name, err)
+		}
+	}
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies the content, mode and mtime of the file oldpath to newpath
+func copyFile(oldpath, newpath string) error {
+	src, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(newpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(newpath, info.ModTime(), info.ModTime())
+}
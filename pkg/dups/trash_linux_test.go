@@ -0,0 +1,44 @@
+package dups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMoveAcross(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content"})
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	if err := os.Chmod(a, 0640); err != nil {
+		t.Fatal(err)
+	}
+	withXattr := unix.Setxattr(a, "user.dups", []byte("kept"), 0) == nil
+	before, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = moveAcross(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(a); !os.IsNotExist(err) {
+		t.Errorf("the file was not removed: %v", err)
+	}
+	after, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("moved to mode %s, mtime %s, want %s and %s", after.Mode(), after.ModTime(), before.Mode(), before.ModTime())
+	}
+	if st, _ := statOf(after); st.uid != uint32(os.Getuid()) {
+		t.Errorf("moved to the owner %d, want %d", st.uid, os.Getuid())
+	}
+	if withXattr {
+		if value, err := getxattr(b, "user.dups"); err != nil || value != "kept" {
+			t.Errorf("xattr user.dups %q, %v after the move", value, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dups
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// trashScan scans a tree of a file and its duplicate with a Trash, and
+// returns the database recording the move, the path of the duplicate and its
+// record
+func trashScan(t *testing.T) (*SQLiteStore, string, TrashedFile) {
+	t.Helper()
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content", "b": "content"})
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "hashes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	trash, err := NewTrash(filepath.Join(t.TempDir(), "trash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScanner(db)
+	s.Linker = &Linker{Trash: trash}
+	if _, err = s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	b := filepath.Join(root, "b")
+	if _, err = os.Lstat(b); !os.IsNotExist(err) {
+		t.Fatalf("the duplicate is still in place: %v", err)
+	}
+	files, err := db.Trashed(trash.Run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != b || files[0].Target != filepath.Join(root, "a") {
+		t.Fatalf("trashed %+v, want b", files)
+	}
+	if want := filepath.Join(trash.Dir, b); files[0].TrashPath != want {
+		t.Errorf("trashed to %s, want %s", files[0].TrashPath, want)
+	}
+	return db, b, files[0]
+}
+
+func TestTrashRestore(t *testing.T) {
+	db, b, f := trashScan(t)
+	if err := f.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(b); err != nil || string(content) != "content" {
+		t.Errorf("restored %q: %v", content, err)
+	}
+	if _, err := os.Lstat(f.TrashPath); !os.IsNotExist(err) {
+		t.Errorf("the file is still in the trash: %v", err)
+	}
+	if err := db.DropTrashed(f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if runs, err := db.TrashRuns(); err != nil || len(runs) != 0 {
+		t.Errorf("runs %+v left after restoring: %v", runs, err)
+	}
+}
+
+func TestTrashRestoreExists(t *testing.T) {
+	_, b, f := trashScan(t)
+	writeFiles(t, filepath.Dir(b), map[string]string{"b": "new content"})
+	err := f.Restore()
+	if _, ok := err.(*SkipError); !ok {
+		t.Errorf("Restore over a new file: %v, want a SkipError", err)
+	}
+	if content, _ := os.ReadFile(b); string(content) != "new content" {
+		t.Errorf("the new file was replaced by %q", content)
+	}
+	if _, err = os.Lstat(f.TrashPath); err != nil {
+		t.Errorf("the file left the trash: %v", err)
+	}
+}
+
+func TestTrashRestoreChanged(t *testing.T) {
+	_, b, f := trashScan(t)
+	if err := os.WriteFile(f.TrashPath, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := f.Restore()
+	if _, ok := err.(*ChangedError); !ok {
+		t.Errorf("Restore of a changed file: %v, want a ChangedError", err)
+	}
+	if _, err = os.Lstat(b); !os.IsNotExist(err) {
+		t.Errorf("the changed file was restored: %v", err)
+	}
+}
+
+type failingRecorder struct{}
+
+func (failingRecorder) RecordTrash(f TrashedFile) error {
+	return errors.New("no space left")
+}
+
+func TestTrashPutRecordFails(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "content"})
+	trash, err := NewTrash(filepath.Join(t.TempDir(), "trash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(root, "a")
+	if _, err = trash.Put(TrashedFile{Path: a}, failingRecorder{}); err == nil {
+		t.Error("Put with a failing record succeeded")
+	}
+	if content, err := os.ReadFile(a); err != nil || string(content) != "content" {
+		t.Errorf("the file was not moved back: %q, %v", content, err)
+	}
+	if _, err = os.Lstat(filepath.Join(trash.Dir, a)); !os.IsNotExist(err) {
+		t.Errorf("the file is still in the trash: %v", err)
+	}
+}
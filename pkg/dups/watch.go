@@ -0,0 +1,330 @@
+package dups
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// DefaultSettle is how long a file must go unwritten to be hashed by a
+// Watcher, when no Settle is set
+const DefaultSettle = 2 * time.Second
+
+// minSettleTick is the shortest period at which the settled files are looked
+// for, however short Settle is
+const minSettleTick = 10 * time.Millisecond
+
+// Watcher dedupes the files of directory trees as they are written, with its
+// Scanner, instead of rescanning the whole trees. Files are hashed once they
+// settle: the events of the watch do not tell when a file is closed, so a file
+// is deemed done once it has not been written for Settle. The duplicates are
+// reported and linked by the Scanner, as those of a scan would be, against the
+// files kept by its earlier scans.
+type Watcher struct {
+	Scanner *Scanner
+	// Settle is how long a file must go unwritten to be hashed
+	Settle time.Duration
+	// Ignore are paths never hashed, like the database of the Store, whose
+	// writes would otherwise be scanned in turn. Paths starting with one of
+	// them and "-" are ignored too, for the journal and WAL of a database.
+	Ignore []string
+}
+
+// NewWatcher returns a Watcher of the files for s to scan
+func NewWatcher(s *Scanner) *Watcher {
+	return &Watcher{Scanner: s, Settle: DefaultSettle}
+}
+
+// Watch watches the directory trees of roots, and the directories created
+// under them, until ctx is done. The files created or written under them are
+// scanned once they settle, in batches. The files already there are not,
+// which is left to a scan of the roots beforehand. Files that are written
+// while still pending when ctx is done are not scanned.
+func (w *Watcher) Watch(ctx context.Context, roots ...string) error {
+	s := w.Scanner
+	settle := w.Settle
+	if settle <= 0 {
+		settle = DefaultSettle
+	}
+	ignore := map[string]bool{}
+	for _, p := range w.Ignore {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		ignore[abs] = true
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	absRoots := make([]string, 0, len(roots))
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		absRoots = append(absRoots, abs)
+		if err := s.watchTree(ctx, watcher, abs, abs, nil); err != nil {
+			return err
+		}
+	}
+	// the longest root first, for rootOf to find the closest one
+	sort.Slice(absRoots, func(i, j int) bool { return len(absRoots[i]) > len(absRoots[j]) })
+
+	var (
+		// pending are the files written, with the time of their last write
+		pending = map[string]time.Time{}
+		// changed are the paths written, removed or renamed since the last
+		// batch, which are no longer what earlier scans kept
+		changed = map[string]bool{}
+		tick    = settle / 2
+	)
+	if tick < minSettleTick {
+		tick = minSettleTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-watcher.Events:
+			if ev.Op == fsnotify.Chmod || ignored(ignore, ev.Name) {
+				// including the link count of a file kept changing, as
+				// another is linked to it
+				continue
+			}
+			changed[ev.Name] = true
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				// removed or renamed away
+				delete(pending, ev.Name)
+				continue
+			}
+			info, err := os.Lstat(ev.Name)
+			if err != nil {
+				// gone already
+				continue
+			}
+			root := rootOf(absRoots, ev.Name)
+			if root == "" {
+				continue
+			}
+			if info.IsDir() {
+				if ev.Op&fsnotify.Create != 0 {
+					// its files may have been written before it was watched
+					err := s.watchTree(ctx, watcher, root, ev.Name, func(path string) {
+						if !ignored(ignore, path) {
+							pending[path] = time.Now()
+						}
+					})
+					if err != nil {
+						s.fail("walk", ev.Name, err)
+					}
+				}
+				continue
+			}
+			if info.Mode().IsRegular() {
+				pending[ev.Name] = time.Now()
+			}
+		case err := <-watcher.Errors:
+			s.fail("walk", "", err)
+		case now := <-ticker.C:
+			files := map[string]os.FileInfo{}
+			for path, written := range pending {
+				if now.Sub(written) < settle {
+					continue
+				}
+				delete(pending, path)
+				info, err := os.Lstat(path)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				if s.selected(rootOf(absRoots, path), path, info) {
+					files[path] = info
+				}
+			}
+			if len(files) == 0 {
+				continue
+			}
+			s.forget(changed)
+			changed = map[string]bool{}
+			if _, err := s.scanFiles(ctx, files); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
+
+// ignored reports whether path is one of the paths of ignore, or one of them
+// followed by "-"
+func ignored(ignore map[string]bool, path string) bool {
+	if ignore[path] {
+		return true
+	}
+	for i := strings.LastIndexByte(path, '-'); i > 0; i = strings.LastIndexByte(path[:i], '-') {
+		if ignore[path[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// rootOf returns the closest of roots that path is under, or "" when there
+// is none. roots are sorted longest first.
+func rootOf(roots []string, path string) string {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return ""
+}
+
+// filterAt returns the state of a walk of root by s.Filter once it reached
+// path, with the directories from root down to the parent of path visited.
+// skip is set when one of them is filtered out.
+func (s *Scanner) filterAt(root, path string) (fw *filterWalk, skip bool) {
+	fw = s.Filter.walk(root)
+	if fw == nil || path == root {
+		return fw, false
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		return fw, true
+	}
+	dir := root
+	visit := func(dir string) bool {
+		info, err := os.Lstat(dir)
+		return err != nil || fw.skip(dir, info)
+	}
+	if visit(dir) {
+		return fw, true
+	}
+	if rel != "." {
+		for _, name := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, name)
+			if visit(dir) {
+				return fw, true
+			}
+		}
+	}
+	return fw, false
+}
+
+// selected reports whether s.Filter selects the file at path, of info, in a
+// walk of root
+func (s *Scanner) selected(root, path string, info os.FileInfo) bool {
+	if root == "" {
+		return false
+	}
+	fw, skip := s.filterAt(root, path)
+	return !skip && !fw.skip(path, info)
+}
+
+// watchTree adds the directories of the tree of dir under root that s.Filter
+// selects to watcher, and calls found, if set, for each regular file in them
+func (s *Scanner) watchTree(ctx context.Context, watcher *fsnotify.Watcher, root, dir string, found func(path string)) error {
+	fw, skip := s.filterAt(root, dir)
+	if skip {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			s.fail("walk", path, err)
+			return nil
+		}
+		if info.IsDir() && s.Linker != nil && s.Linker.Trash != nil && s.Linker.Trash.contains(path) {
+			return filepath.SkipDir
+		}
+		if fw.skip(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				// like running out of inotify watches
+				s.fail("walk", path, fmt.Errorf("watching: %v", err))
+			}
+		} else if found != nil && info.Mode().IsRegular() {
+			found(path)
+		}
+		return nil
+	})
+}
+
+// forget drops the files of paths, and those under them, from the files kept
+// by earlier scans, as they were written, removed or renamed since, and no
+// longer have the content they were kept for
+func (s *Scanner) forget(paths map[string]bool) {
+	if len(paths) == 0 {
+		return
+	}
+	under := func(path string) bool {
+		for {
+			if paths[path] {
+				return true
+			}
+			parent := filepath.Dir(path)
+			if parent == path {
+				return false
+			}
+			path = parent
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, kept := range s.found {
+		targets := kept[:0]
+		for _, t := range kept {
+			if !under(t.path) {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			delete(s.found, hash)
+		} else {
+			s.found[hash] = targets
+		}
+	}
+	for hash, first := range s.archived {
+		if archive, _, ok := SplitMemberPath(first); ok && under(archive) {
+			delete(s.archived, hash)
+		}
+	}
+}
+
+// scanFiles scans the files of files, with their stat info, as a run of their
+// own, and returns its Stats
+func (s *Scanner) scanFiles(ctx context.Context, files map[string]os.FileInfo) (Stats, error) {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	before := s.Stats()
+	r := s.newRun(ctx)
+	for path, info := range files {
+		path, info := path, info
+		s.count(func(st *Stats) {
+			st.FilesSeen++
+			st.BytesSeen += info.Size()
+		})
+		r.spawn(func() { r.scanFile(path, info) })
+	}
+	err := r.finish(nil)
+	return s.Stats().Sub(before), err
+}
@@ -0,0 +1,33 @@
+package dups
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchShortSettle(t *testing.T) {
+	root := t.TempDir()
+	s := newTestScanner(NewMapStore())
+	w := NewWatcher(s)
+	w.Settle = time.Nanosecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Watch(ctx, root) }()
+
+	// the watch starts before Watch returns, so the files are written until
+	// one is seen
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; s.Stats().FilesHashed == 0; i++ {
+		if time.Now().After(deadline) {
+			t.Fatal("no file scanned by the watch")
+		}
+		writeFiles(t, root, map[string]string{filepath.Join("d", string(rune('a'+i%26))): "content"})
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,56 @@
+package dups
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrs returns the extended attributes of path, by name. Filesystems
+// without support for them have none.
+func xattrs(path string) (map[string]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err == unix.ENOTSUP || err == unix.ENODATA {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getxattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+func setxattr(path, name, value string) error {
+	return unix.Setxattr(path, name, []byte(value), 0)
+}
+
+func getxattr(path, name string) (string, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err == unix.ENODATA {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Getxattr(path, name, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
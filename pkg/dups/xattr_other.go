@@ -0,0 +1,14 @@
+//go:build !linux
+
+package dups
+
+import "errors"
+
+// xattrs is only implemented on linux, elsewhere files have none
+func xattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setxattr(path, name, value string) error {
+	return errors.New("xattrs are not supported")
+}